@@ -0,0 +1,54 @@
+package s3cache
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// accelerateURL rewrites the bucket URL u to address the same bucket, in
+// virtual-hosted style, on the S3 Transfer Acceleration endpoint, e.g.
+// "https://mybucket.s3-accelerate.amazonaws.com/" for
+// "https://s3-us-west-2.amazonaws.com/mybucket". Any path after the bucket
+// name is kept.
+func (c *Cache) accelerateURL(u *url.URL) error {
+	if c.SignatureV2 {
+		return errors.New("s3cache: Accelerate requires Signature Version 4")
+	}
+	if _, ok := accessPointARN(u.Hostname()); ok {
+		return errors.New("s3cache: Accelerate cannot be used with access points")
+	}
+	var bucket string
+	if c.PathStyle || isPathStyleAmazonHost(u.Hostname()) {
+		var rest string
+		bucket, rest, _ = strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+		u.Path = "/" + rest
+	} else {
+		bucket = bucketFromHost(u.Hostname())
+	}
+	if !accelerateBucket(bucket) {
+		return fmt.Errorf("s3cache: bucket name %q cannot be used with Accelerate, which requires a DNS-compliant name without periods", bucket)
+	}
+	u.Host = bucket + ".s3-accelerate.amazonaws.com"
+	return nil
+}
+
+// accelerateBucket reports whether bucket is a valid name for a bucket
+// accessed through S3 Transfer Acceleration: 3 to 63 lowercase letters,
+// digits and hyphens, beginning and ending with a letter or digit.
+func accelerateBucket(bucket string) bool {
+	if len(bucket) < 3 || len(bucket) > 63 {
+		return false
+	}
+	for i := 0; i < len(bucket); i++ {
+		ch := bucket[i]
+		switch {
+		case 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9':
+		case ch == '-' && i > 0 && i < len(bucket)-1:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package s3cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// accessPointLabel is the label that identifies the endpoint host of an S3
+// access point, such as
+// "my-ap-123456789012.s3-accesspoint.us-west-2.amazonaws.com".
+const accessPointLabel = "s3-accesspoint"
+
+// NewForAccessPoint is like New, but it stores cache entries in the bucket
+// of the S3 access point with the given ARN, e.g.
+// "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap", sending requests to
+// the access point's endpoint and signing them for its region. Set
+// DualStack to use the access point's dual-stack endpoint. An access point
+// alias, which can be used in place of a bucket name, needs no special
+// support: pass New the URL of the bucket named by the alias.
+//
+// Access points require Signature Version 4, and cannot be used with
+// Accelerate.
+func NewForAccessPoint(arn string) (*Cache, error) {
+	name, account, region, err := parseAccessPointARN(arn)
+	if err != nil {
+		return nil, err
+	}
+	c := New("https://" + name + "-" + account + "." + accessPointLabel + "." + region + ".amazonaws.com")
+	c.Region = region
+	return c, nil
+}
+
+// parseAccessPointARN returns the name, AWS account ID and region of the S3
+// access point with the given ARN, which may be of the form
+// "arn:aws:s3:<region>:<account>:accesspoint/<name>" or
+// "arn:aws:s3:<region>:<account>:accesspoint:<name>".
+func parseAccessPointARN(arn string) (name, account, region string, err error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "s3" {
+		return "", "", "", fmt.Errorf("s3cache: %q is not an S3 access point ARN", arn)
+	}
+	if parts[1] != "aws" && parts[1] != "aws-us-gov" {
+		return "", "", "", fmt.Errorf("s3cache: access point ARN %q has unsupported partition %q", arn, parts[1])
+	}
+	region, account = parts[3], parts[4]
+	name, ok := strings.CutPrefix(parts[5], "accesspoint/")
+	if !ok {
+		name, ok = strings.CutPrefix(parts[5], "accesspoint:")
+	}
+	if !ok || name == "" || strings.ContainsAny(name, "/:.") || region == "" || len(account) != 12 || strings.Trim(account, "0123456789") != "" {
+		return "", "", "", fmt.Errorf("s3cache: %q is not an S3 access point ARN", arn)
+	}
+	return name, account, region, nil
+}
+
+// accessPointARN returns the ARN of the S3 access point whose endpoint host
+// is host, and false if host is not an access point endpoint.
+func accessPointARN(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".amazonaws.com") {
+		return "", false
+	}
+	labels := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	if len(labels) < 3 || labels[1] != accessPointLabel {
+		return "", false
+	}
+	// The first label is the access point's name, followed by a hyphen
+	// and the 12-digit ID of the account that owns it.
+	i := strings.LastIndexByte(labels[0], '-')
+	if i <= 0 || len(labels[0])-i-1 != 12 {
+		return "", false
+	}
+	name, account, region := labels[0][:i], labels[0][i+1:], labels[len(labels)-1]
+	partition := "aws"
+	if strings.HasPrefix(region, "us-gov-") {
+		partition = "aws-us-gov"
+	}
+	return "arn:" + partition + ":s3:" + region + ":" + account + ":accesspoint/" + name, true
+}
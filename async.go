@@ -0,0 +1,162 @@
+package s3cache
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// ErrQueueFull is reported to a Cache's OnError callback when an AsyncCache
+// drops a write because its queue is full.
+var ErrQueueFull = errors.New("s3cache: async write queue is full")
+
+// An AsyncCache performs writes to a Cache in the background, so that Set
+// and Delete return without waiting for S3. Writes are queued and performed
+// by a pool of workers; writes for the same key are performed in the order
+// in which they were made. Get reads from S3 directly and does not see
+// writes that are still queued.
+//
+// Queued writes are lost if the process exits before they are performed.
+// Call Flush to wait for them, and Close to stop the workers on shutdown.
+//
+// An AsyncCache is safe for concurrent use by multiple goroutines.
+type AsyncCache struct {
+	// S3 is the underlying S3-backed cache.
+	S3 *Cache
+
+	// Block indicates whether Set and Delete block when the queue is full.
+	// If false, writes are dropped when the queue is full, and ErrQueueFull
+	// is reported to S3's OnError callback.
+	Block bool
+
+	queues []chan asyncWrite
+	wg     sync.WaitGroup // running workers
+
+	mu     sync.RWMutex // guards closed, and sends on queues
+	closed bool
+
+	pendingMu   sync.Mutex
+	pending     int // writes queued but not yet performed
+	pendingDone *sync.Cond
+}
+
+type asyncWrite struct {
+	key    string
+	resp   []byte
+	delete bool
+}
+
+// NewAsync returns an AsyncCache that performs writes to c using the given
+// number of workers, queueing up to queueSize writes.
+func NewAsync(c *Cache, workers, queueSize int) *AsyncCache {
+	if workers < 1 {
+		workers = 1
+	}
+	perWorker := queueSize / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+	a := &AsyncCache{S3: c, queues: make([]chan asyncWrite, workers)}
+	a.pendingDone = sync.NewCond(&a.pendingMu)
+	for i := range a.queues {
+		a.queues[i] = make(chan asyncWrite, perWorker)
+		a.wg.Add(1)
+		go a.work(a.queues[i])
+	}
+	return a
+}
+
+func (a *AsyncCache) Get(key string) (resp []byte, ok bool) {
+	return a.S3.Get(key)
+}
+
+func (a *AsyncCache) Set(key string, resp []byte) {
+	a.enqueue(asyncWrite{key: key, resp: resp})
+}
+
+func (a *AsyncCache) Delete(key string) {
+	a.enqueue(asyncWrite{key: key, delete: true})
+}
+
+// Flush waits until all writes queued so far have been performed.
+func (a *AsyncCache) Flush() {
+	a.pendingMu.Lock()
+	for a.pending > 0 {
+		a.pendingDone.Wait()
+	}
+	a.pendingMu.Unlock()
+}
+
+// Close performs all queued writes and stops the workers. Writes made after
+// Close are performed synchronously. Close is idempotent.
+func (a *AsyncCache) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		for _, q := range a.queues {
+			close(q)
+		}
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+	return nil
+}
+
+func (a *AsyncCache) enqueue(w asyncWrite) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.perform(w)
+		return
+	}
+
+	// Writes for the same key always go to the same worker, so that they
+	// are performed in order.
+	h := fnv.New32a()
+	h.Write([]byte(w.key))
+	q := a.queues[h.Sum32()%uint32(len(a.queues))]
+
+	a.pendingMu.Lock()
+	a.pending++
+	a.pendingMu.Unlock()
+	if a.Block {
+		q <- w
+		return
+	}
+	select {
+	case q <- w:
+	default:
+		a.done()
+		op := "Set"
+		if w.delete {
+			op = "Delete"
+		}
+		a.S3.onError(op, w.key, ErrQueueFull)
+	}
+}
+
+func (a *AsyncCache) work(q <-chan asyncWrite) {
+	defer a.wg.Done()
+	for w := range q {
+		a.perform(w)
+		a.done()
+	}
+}
+
+func (a *AsyncCache) perform(w asyncWrite) {
+	if w.delete {
+		a.S3.Delete(w.key)
+	} else {
+		a.S3.Set(w.key, w.resp)
+	}
+}
+
+// done records that a queued write has been performed or dropped.
+func (a *AsyncCache) done() {
+	a.pendingMu.Lock()
+	a.pending--
+	if a.pending == 0 {
+		a.pendingDone.Broadcast()
+	}
+	a.pendingMu.Unlock()
+}
@@ -0,0 +1,62 @@
+package s3cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipBodyHeader records the length of the header block of a cache entry
+// that is a serialized HTTP response stored with CompressBody. The header
+// block is stored as is, and followed by the gzipped body.
+const gzipBodyHeader = "X-Amz-Meta-S3cache-Gzip-Body"
+
+// headerBlockLen returns the length of the header block of resp, up to and
+// including the blank line that ends it, if resp is a serialized HTTP
+// response, and -1 otherwise.
+func headerBlockLen(resp []byte) int {
+	if !bytes.HasPrefix(resp, []byte("HTTP/")) {
+		return -1
+	}
+	n := -1
+	if i := bytes.Index(resp, []byte("\r\n\r\n")); i >= 0 {
+		n = i + 4
+	}
+	// Tolerate bare LF line endings, as net/http does.
+	if i := bytes.Index(resp, []byte("\n\n")); i >= 0 && (n < 0 || i+2 < n) {
+		n = i + 2
+	}
+	return n
+}
+
+// gzipBody writes to w the serialized HTTP response resp, whose header
+// block is n bytes long, with its body gzipped.
+func gzipBody(w *bytes.Buffer, resp []byte, n int) error {
+	w.Write(resp[:n])
+	gw := getGzipWriter(w)
+	defer putGzipWriter(gw)
+	if _, err := gw.Write(resp[n:]); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// gunzipBody returns a reader for the cache entry in body, which was stored
+// by gzipBody with a header block n bytes long.
+func gunzipBody(body io.ReadCloser, n int64) (io.ReadCloser, error) {
+	header := make([]byte, n)
+	if _, err := io.ReadFull(body, header); err != nil {
+		body.Close()
+		return nil, err
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	r := &gzipReader{Reader: zr, body: body}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(header), r), r}, nil
+}
@@ -0,0 +1,67 @@
+package s3cache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func TestCompressBody(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 100)
+	tests := []struct {
+		name   string
+		header string // the header block, stored uncompressed; "" if none
+		resp   string
+	}{
+		{"plain", "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n", body},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", "6\r\nhello,\r\n" + strings.Repeat("11\r\n"+`{"hello":"world"}`+"\r\n", 100) + "0\r\n\r\n"},
+		{"bare LF", "HTTP/1.0 200 OK\nX-A: b\n\n", body},
+		{"folded header", "HTTP/1.1 200 OK\r\nX-Long: a\r\n b\r\nX-Empty:\r\nX-Dup: 1\r\nX-Dup: 2\r\n\r\n", body},
+		{"blank line in body", "HTTP/1.1 200 OK\r\n\r\n", "a\r\n\r\nb\n\n" + body},
+		{"no body", "HTTP/1.1 204 No Content\r\nDate: Mon, 01 Jan 2024 00:00:00 GMT\r\n\r\n", ""},
+		{"binary body", "HTTP/1.1 200 OK\r\n\r\n", "\x00\xff\x1f\x8b" + body},
+		{"unterminated headers", "", "HTTP/1.1 200 OK\r\nX-A: " + body},
+		{"not a response", "", body},
+	}
+	for _, test := range tests {
+		st := memstore.New()
+		c := &s3cache.Cache{Store: st, CompressBody: true}
+		resp := []byte(test.header + test.resp)
+		c.Set("k", resp)
+		if got, ok := c.Get("k"); !ok || !bytes.Equal(got, resp) {
+			t.Errorf("%s: Get returned %q, %v; want the entry", test.name, got, ok)
+		}
+
+		raw, _, err := st.Get(context.Background(), c.ObjectKey("k"), nil)
+		if err != nil || raw == nil {
+			t.Fatalf("%s: reading the object: %v", test.name, err)
+		}
+		object, _ := ioutil.ReadAll(raw)
+		raw.Close()
+		if test.header != "" && !bytes.HasPrefix(object, []byte(test.header)) {
+			t.Errorf("%s: the object does not begin with the uncompressed header block: %q", test.name, object)
+		}
+		if test.header == "" {
+			// Entries that are not serialized responses are stored as is.
+			if !bytes.Equal(object, resp) {
+				t.Errorf("%s: stored %d bytes for a %d-byte entry, want it uncompressed", test.name, len(object), len(resp))
+			}
+			if got, ok, err := c.GetRange("k", 0, 9); err != nil || !ok || !bytes.Equal(got, resp[:10]) {
+				t.Errorf("%s: GetRange = %q, %v, %v", test.name, got, ok, err)
+			}
+			continue
+		}
+		if len(object) >= len(resp) && test.resp != "" {
+			t.Errorf("%s: stored %d bytes for a %d-byte entry", test.name, len(object), len(resp))
+		}
+		if _, _, err := c.GetRange("k", 0, 9); !errors.Is(err, s3cache.ErrRangeCompressed) {
+			t.Errorf("%s: GetRange = %v, want ErrRangeCompressed", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package s3cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by operations that are not attempted because
+// BreakerThreshold consecutive operations have failed. It is reported to
+// OnError when the circuit opens, and to OnSkip for each operation skipped
+// while it is open.
+var ErrCircuitOpen = errors.New("s3cache: circuit breaker is open")
+
+// breaker is the state of a Cache's circuit breaker.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // zero if the circuit is closed
+	probing   bool      // whether an operation is probing a half-open circuit
+}
+
+// breakerAllow returns ErrCircuitOpen if the circuit breaker is open, and
+// nil if an operation may be attempted. Once the cooldown has passed, a
+// single operation is allowed, to probe whether S3 has recovered.
+func (c *Cache) breakerAllow() error {
+	if c.BreakerThreshold <= 0 {
+		return nil
+	}
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || c.now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// breakerDone records the outcome of an operation allowed by breakerAllow,
+// opening the circuit if it failed BreakerThreshold times in a row, or if
+// it was probing a half-open circuit. Only failures that indicate that S3 is
+// unavailable, such as 5xx responses including throttling, are counted.
+func (c *Cache) breakerDone(op, key string, err error) {
+	if c.BreakerThreshold <= 0 {
+		return
+	}
+	b := &c.breaker
+	b.mu.Lock()
+	if err == nil || !unavailable(err) {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		b.mu.Unlock()
+		return
+	}
+	b.failures++
+	opened := b.probing || (b.openUntil.IsZero() && b.failures >= c.BreakerThreshold)
+	if opened {
+		cooldown := c.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = 30 * time.Second
+		}
+		b.openUntil = c.now().Add(cooldown)
+		b.probing = false
+	}
+	b.mu.Unlock()
+	if opened {
+		c.onError(op, key, ErrCircuitOpen)
+	}
+}
+
+// breakerCancel records that an operation allowed by breakerAllow was not
+// attempted after all.
+func (c *Cache) breakerCancel() {
+	if c.BreakerThreshold <= 0 {
+		return
+	}
+	c.breaker.mu.Lock()
+	c.breaker.probing = false
+	c.breaker.mu.Unlock()
+}
@@ -0,0 +1,290 @@
+package s3cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clear deletes all cache entries, i.e., all objects in the bucket whose
+// keys begin with the cache's Prefix and KeyVersion. If both are empty, it
+// deletes every object in the bucket. Like PruneOlderThan, it deletes
+// pages of the listing while listing the next.
+func (c *Cache) Clear() error {
+	return c.ClearContext(context.Background(), nil)
+}
+
+// ClearContext is like Clear, but stops listing and deleting objects when
+// ctx is done, and calls progress, if it is not nil, with the number of
+// objects deleted so far after each batch of deletes. Calls to progress are
+// not concurrent. If ctx is done before the bucket is cleared,
+// ClearContext returns an error wrapping ctx.Err() that reports how many
+// objects were deleted.
+func (c *Cache) ClearContext(ctx context.Context, progress func(deleted int)) error {
+	if err := c.permit("Delete"); err != nil {
+		return err
+	}
+	deleted, err := c.deleteListed(ctx, func(ObjectInfo) bool { return true }, progress)
+	if ctx.Err() != nil {
+		return fmt.Errorf("s3cache: clear stopped after deleting %d objects: %w", deleted, ctx.Err())
+	}
+	return err
+}
+
+// PruneOlderThan deletes the cache entries stored before cutoff, as
+// indicated by the LastModified time of their objects in the bucket
+// listing, and returns the number of entries deleted. Entries copied with
+// CopyFrom are aged from when they were copied. The blobs of deduplicated
+// entries are not deleted; see CollectBlobs.
+//
+// If the Store supports batch deletes, each page of the listing is deleted
+// as soon as it is listed, while the next pages are listed. Up to
+// MaxConcurrency pages are deleted at a time, and listing waits for one of
+// them to finish before continuing, so only those pages are held in memory.
+//
+// If some of the entries could not be deleted, PruneOlderThan deletes the
+// others and returns a BatchError describing the failures.
+func (c *Cache) PruneOlderThan(cutoff time.Time) (deleted int, err error) {
+	if err := c.permit("Delete"); err != nil {
+		return 0, err
+	}
+	return c.deleteListed(context.Background(), func(o ObjectInfo) bool {
+		return o.LastModified.Before(cutoff) && c.isEntryKey(o.Key)
+	}, nil)
+}
+
+// deleteListed deletes the cache's objects for which match returns true,
+// and returns the number of objects deleted. If the Store is a
+// BatchDeleter, each page of the listing is deleted concurrently with
+// listing and deleting the others, within the Cache's MaxConcurrency.
+// Otherwise, the objects of each page are deleted concurrently before the
+// next page is listed. If progress is not nil, it is called with the number
+// of objects deleted so far after each page is deleted. No further pages
+// are listed once ctx is done.
+func (c *Cache) deleteListed(ctx context.Context, match func(ObjectInfo) bool, progress func(deleted int)) (deleted int, err error) {
+	var (
+		mu   sync.Mutex // guards deleted and errs
+		errs BatchError
+		wg   sync.WaitGroup
+	)
+	done := func(keys []string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch be, ok := err.(BatchError); {
+		case err == nil:
+			deleted += len(keys)
+		case ok:
+			deleted += len(keys) - len(be)
+			errs = append(errs, be...)
+		default:
+			errs = append(errs, err)
+		}
+		if progress != nil {
+			progress(deleted)
+		}
+	}
+	_, batch := c.store().(BatchDeleter)
+	err = c.store().List(ctx, c.keyPrefix(), func(objects []ObjectInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var keys []string
+		for _, o := range objects {
+			if match(o) {
+				keys = append(keys, o.Key)
+			}
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		if !batch {
+			done(keys, c.deleteObjects(ctx, keys))
+			return nil
+		}
+		// The page's batches share the slot, and listing waits for a
+		// free slot, so that only the pages being deleted are in memory.
+		ctx, release, err := c.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			done(keys, c.deleteObjects(ctx, keys))
+		}()
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		return deleted, err
+	}
+	if len(errs) > 0 {
+		return deleted, errs
+	}
+	return deleted, nil
+}
+
+// DeleteMulti deletes the cache entries for keys, using batched S3
+// DeleteObjects requests of up to 1000 keys each if the Store supports
+// them. Like Delete, it also deletes the entries from FallbackCache. If
+// some of the entries could not be deleted, it returns a BatchError whose
+// ObjectErrors identify the failed cache keys.
+func (c *Cache) DeleteMulti(keys []string) error {
+	if err := c.permit("Delete"); err != nil {
+		return err
+	}
+	cacheKeys := make(map[string]string, len(keys))
+	objectKeys := make([]string, len(keys))
+	for i, key := range keys {
+		c.forgetEntry(key)
+		objectKeys[i] = c.ObjectKey(key)
+		cacheKeys[objectKeys[i]] = key
+	}
+	err := c.deleteObjects(context.Background(), objectKeys)
+	be, ok := err.(BatchError)
+	if !ok {
+		return err
+	}
+	for _, err := range be {
+		if oe, ok := err.(*ObjectError); ok {
+			if key, ok := cacheKeys[oe.Key]; ok {
+				oe.Key = key
+			}
+			c.onError("Delete", oe.Key, oe)
+		}
+	}
+	return be
+}
+
+// GetMulti returns the cache entries for keys that exist, fetching them
+// concurrently within the Cache's MaxConcurrency. Keys that miss are absent
+// from the returned map. If some of the entries could not be retrieved, it
+// returns the others together with a BatchError whose ObjectErrors identify
+// the failed cache keys; each failure is also reported to OnError.
+func (c *Cache) GetMulti(keys []string) (map[string][]byte, error) {
+	return c.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext is like GetMulti, but the S3 requests are aborted if ctx
+// is cancelled or its deadline passes, in which case it returns the entries
+// already retrieved and ctx's error.
+func (c *Cache) GetMultiContext(ctx context.Context, keys []string) (map[string][]byte, error) {
+	var (
+		mu       sync.Mutex // guards hits and errs
+		hits     = make(map[string][]byte)
+		errs     BatchError
+		firstErr error
+		wg       sync.WaitGroup
+		seen     = make(map[string]bool, len(keys))
+	)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ctx, release, err := c.acquire(ctx)
+		if err != nil {
+			firstErr = err
+			break
+		}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer release()
+			resp, ok, err := c.getContext(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case ok:
+				hits[key] = resp
+			case err != nil && err != ErrNegativeCached && !skipped(err):
+				errs = append(errs, &ObjectError{Key: key, Message: err.Error()})
+			}
+		}(key)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return hits, firstErr
+	}
+	if len(errs) > 0 {
+		return hits, errs
+	}
+	return hits, nil
+}
+
+// Keys returns the S3 object keys of all cache entries. Since cache keys
+// are hashed by default, these are not the cache keys passed to Set. The
+// blob objects of deduplicated entries and index objects are not cache
+// entries, and are omitted.
+func (c *Cache) Keys() ([]string, error) {
+	var keys []string
+	err := c.store().List(context.Background(), c.keyPrefix(), func(objects []ObjectInfo) error {
+		for _, o := range objects {
+			if c.isEntryKey(o.Key) {
+				keys = append(keys, o.Key)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// List returns information about the S3 objects of all cache entries. Like
+// Keys, it omits blob and index objects.
+func (c *Cache) List() ([]ObjectInfo, error) {
+	var all []ObjectInfo
+	err := c.store().List(context.Background(), c.keyPrefix(), func(objects []ObjectInfo) error {
+		for _, o := range objects {
+			if c.isEntryKey(o.Key) {
+				all = append(all, o)
+			}
+		}
+		return nil
+	})
+	return all, err
+}
+
+// isEntryKey reports whether objectKey, listed under the cache's key
+// prefix, is the key of a cache entry rather than of a blob or index
+// object.
+func (c *Cache) isEntryKey(objectKey string) bool {
+	return !c.isBlobKey(objectKey) && !c.isIndexKey(objectKey)
+}
+
+// ObjectInfo describes an object listed in a bucket.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+// An ObjectError describes the failure to delete a single object in a
+// batch.
+type ObjectError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+func (e *ObjectError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s: %s", e.Key, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Key, e.Code, e.Message)
+}
+
+// A BatchError is returned by batch operations that fail for some, but not
+// necessarily all, of the objects involved. It lists each failure.
+type BatchError []error
+
+func (e BatchError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,114 @@
+package s3cache_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// TestKeys checks that Keys and List omit the blob objects of
+// deduplicated entries and index objects.
+func TestKeys(t *testing.T) {
+	st := memstore.New()
+	c := &s3cache.Cache{Store: st, KeyVersion: "v1", Dedup: true, Index: true}
+	c.Set("a", []byte("same"))
+	c.Set("b", []byte("same"))
+	if err := c.FlushIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Len(); n != 4 {
+		t.Fatalf("%d objects stored, want 2 entries, a blob and an index object", n)
+	}
+
+	want := []string{c.ObjectKey("a"), c.ObjectKey("b")}
+	sort.Strings(want)
+	keys, err := c.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != len(want) || keys[0] != want[0] || keys[1] != want[1] {
+		t.Errorf("Keys = %q, want %q", keys, want)
+	}
+	objects, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, o := range objects {
+		listed = append(listed, o.Key)
+	}
+	sort.Strings(listed)
+	if len(listed) != len(want) || listed[0] != want[0] || listed[1] != want[1] {
+		t.Errorf("List returned %q, want %q", listed, want)
+	}
+}
+
+// getCountingStore is a Store that counts its Get calls.
+type getCountingStore struct {
+	*memstore.Store
+	gets int
+}
+
+func (s *getCountingStore) Get(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, error) {
+	s.gets++
+	return s.Store.Get(ctx, key, h)
+}
+
+// TestDeleteMulti checks that DeleteMulti forgets the deleted entries as
+// Delete does, and reports failures by cache key.
+func TestDeleteMulti(t *testing.T) {
+	st := &getCountingStore{Store: memstore.New()}
+	fallback := &s3cache.Cache{Store: memstore.New()}
+	c := &s3cache.Cache{
+		Store:                 st,
+		FallbackCache:         fallback,
+		WriteFallback:         true,
+		ReadAfterWriteRetries: 3,
+		RetryBaseDelay:        time.Millisecond,
+	}
+	c.Set("a", []byte("v"))
+	c.Set("b", []byte("v"))
+	if err := c.DeleteMulti([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, ok := fallback.Get(key); ok {
+			t.Errorf("DeleteMulti did not delete the fallback's entry for %s", key)
+		}
+		st.gets = 0
+		if _, ok := c.Get(key); ok {
+			t.Errorf("%s was not deleted", key)
+		}
+		// A deleted entry is not awaited as a recent write.
+		if st.gets != 1 {
+			t.Errorf("Get of deleted %s made %d Store calls, want 1", key, st.gets)
+		}
+	}
+
+	c.Set("c", []byte("v"))
+	c.OnError = func(string, string, error) {}
+	st.Fail("Delete", 1, &s3cache.StatusError{StatusCode: 403, Body: s3Error("AccessDenied")})
+	err := c.DeleteMulti([]string{"c"})
+	be, ok := err.(s3cache.BatchError)
+	if !ok || len(be) != 1 {
+		t.Fatalf("got %v, want a BatchError for c", err)
+	}
+	oe, ok := be[0].(*s3cache.ObjectError)
+	if !ok || oe.Key != "c" || oe.Code != "AccessDenied" {
+		t.Fatalf("got %#v, want an AccessDenied ObjectError for c", be[0])
+	}
+	if msg := oe.Error(); !strings.HasPrefix(msg, "c: AccessDenied: ") {
+		t.Errorf("got error %q", msg)
+	}
+	if msg := (&s3cache.ObjectError{Key: "k", Message: "failed"}).Error(); msg != "k: failed" {
+		t.Errorf("without a code, got error %q", msg)
+	}
+}
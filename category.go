@@ -0,0 +1,84 @@
+package s3cache
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// An ErrorCategory classifies the errors returned by S3, so that callers
+// can respond to them appropriately, e.g. by backing off when throttled.
+type ErrorCategory string
+
+// Categories of S3 errors.
+const (
+	// CategoryThrottled is the category of errors reporting that S3 is
+	// throttling requests, such as 503 SlowDown.
+	CategoryThrottled ErrorCategory = "throttled"
+
+	// CategoryServerError is the category of other 5xx errors.
+	CategoryServerError ErrorCategory = "server-error"
+
+	// CategoryNotFound is the category of errors reporting that an object
+	// or bucket does not exist.
+	CategoryNotFound ErrorCategory = "not-found"
+
+	// CategoryAuth is the category of errors reporting that a request was
+	// not authorized, e.g. because of missing permissions or expired
+	// credentials.
+	CategoryAuth ErrorCategory = "auth"
+
+	// CategoryClientError is the category of other 4xx errors.
+	CategoryClientError ErrorCategory = "client-error"
+)
+
+// ErrThrottled matches, with errors.Is, the errors returned when S3 is
+// throttling requests (see CategoryThrottled).
+var ErrThrottled = errors.New("s3cache: request throttled by S3")
+
+// Category returns the category of the error, or "" if its status is not
+// an error.
+func (e *StatusError) Category() ErrorCategory {
+	switch code := e.code(); {
+	case e.StatusCode == http.StatusTooManyRequests, code == "SlowDown", code == "Throttling", code == "ThrottlingException", code == "RequestLimitExceeded", code == "TooManyRequests":
+		return CategoryThrottled
+	case e.StatusCode == http.StatusServiceUnavailable && code == "":
+		// Responses to HEAD requests have no body, and S3 responds 503
+		// mostly to throttle requests.
+		return CategoryThrottled
+	case e.StatusCode >= 500:
+		return CategoryServerError
+	case e.StatusCode == http.StatusNotFound:
+		return CategoryNotFound
+	case e.StatusCode == http.StatusUnauthorized, e.StatusCode == http.StatusForbidden,
+		code == "ExpiredToken", code == "InvalidToken", code == "AuthorizationHeaderMalformed":
+		return CategoryAuth
+	case e.StatusCode >= 400:
+		return CategoryClientError
+	}
+	return ""
+}
+
+// code returns the S3 error code in the body of the error response, such as
+// "NoSuchKey", or "" if there is none.
+func (e *StatusError) code() string {
+	_, rest, ok := strings.Cut(e.Body, "<Code>")
+	if !ok {
+		return ""
+	}
+	code, _, ok := strings.Cut(rest, "</Code>")
+	if !ok {
+		return ""
+	}
+	return code
+}
+
+// CategoryOf returns the category of the S3 error wrapped by err, or "" if
+// err does not wrap an error response from S3.
+func CategoryOf(err error) ErrorCategory {
+	var e *StatusError
+	if errors.As(err, &e) {
+		return e.Category()
+	}
+	return ""
+}
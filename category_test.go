@@ -0,0 +1,82 @@
+package s3cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// s3Error returns the body of an S3 error response with the given code.
+func s3Error(code string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?><Error><Code>` + code + `</Code><Message>m</Message><RequestId>r</RequestId></Error>`
+}
+
+func TestCategoryOf(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		want      s3cache.ErrorCategory
+		throttled bool
+		notFound  bool
+	}{
+		{"SlowDown", &s3cache.StatusError{StatusCode: 503, Body: s3Error("SlowDown")}, s3cache.CategoryThrottled, true, false},
+		{"503 without a body", &s3cache.StatusError{StatusCode: 503}, s3cache.CategoryThrottled, true, false},
+		{"429", &s3cache.StatusError{StatusCode: 429}, s3cache.CategoryThrottled, true, false},
+		{"Throttling", &s3cache.StatusError{StatusCode: 400, Body: s3Error("Throttling")}, s3cache.CategoryThrottled, true, false},
+		{"RequestLimitExceeded", &s3cache.StatusError{StatusCode: 403, Body: s3Error("RequestLimitExceeded")}, s3cache.CategoryThrottled, true, false},
+		{"InternalError", &s3cache.StatusError{StatusCode: 500, Body: s3Error("InternalError")}, s3cache.CategoryServerError, false, false},
+		{"503 ServiceUnavailable", &s3cache.StatusError{StatusCode: 503, Body: s3Error("ServiceUnavailable")}, s3cache.CategoryServerError, false, false},
+		{"NoSuchKey", &s3cache.StatusError{StatusCode: 404, Body: s3Error("NoSuchKey")}, s3cache.CategoryNotFound, false, true},
+		{"404 without a body", &s3cache.StatusError{StatusCode: 404}, s3cache.CategoryNotFound, false, true},
+		{"NoSuchBucket", &s3cache.StatusError{StatusCode: 404, Body: s3Error("NoSuchBucket")}, s3cache.CategoryNotFound, false, false},
+		{"AccessDenied", &s3cache.StatusError{StatusCode: 403, Body: s3Error("AccessDenied")}, s3cache.CategoryAuth, false, false},
+		{"401", &s3cache.StatusError{StatusCode: 401}, s3cache.CategoryAuth, false, false},
+		{"ExpiredToken", &s3cache.StatusError{StatusCode: 400, Body: s3Error("ExpiredToken")}, s3cache.CategoryAuth, false, false},
+		{"InvalidArgument", &s3cache.StatusError{StatusCode: 400, Body: s3Error("InvalidArgument")}, s3cache.CategoryClientError, false, false},
+		{"412", &s3cache.StatusError{StatusCode: 412}, s3cache.CategoryClientError, false, false},
+		{"304", &s3cache.StatusError{StatusCode: 304}, "", false, false},
+		{"wrapped", fmt.Errorf("s3cache: Get k: %w", &s3cache.StatusError{StatusCode: 503, Body: s3Error("SlowDown")}), s3cache.CategoryThrottled, true, false},
+		{"network error", errors.New("connection reset by peer"), "", false, false},
+		{"context", context.DeadlineExceeded, "", false, false},
+		{"nil", nil, "", false, false},
+	}
+	for _, test := range tests {
+		if got := s3cache.CategoryOf(test.err); got != test.want {
+			t.Errorf("%s: CategoryOf = %q, want %q", test.name, got, test.want)
+		}
+		if got := errors.Is(test.err, s3cache.ErrThrottled); got != test.throttled {
+			t.Errorf("%s: errors.Is(err, ErrThrottled) = %v, want %v", test.name, got, test.throttled)
+		}
+		if got := errors.Is(test.err, s3cache.ErrNotFound); got != test.notFound {
+			t.Errorf("%s: errors.Is(err, ErrNotFound) = %v, want %v", test.name, got, test.notFound)
+		}
+	}
+}
+
+// TestRetryCategories checks that throttling and server errors are retried,
+// and other errors are not.
+func TestRetryCategories(t *testing.T) {
+	for _, test := range []struct {
+		err   *s3cache.StatusError
+		retry bool
+	}{
+		{&s3cache.StatusError{StatusCode: 503, Body: s3Error("SlowDown")}, true},
+		{&s3cache.StatusError{StatusCode: 500, Body: s3Error("InternalError")}, true},
+		{&s3cache.StatusError{StatusCode: 403, Body: s3Error("AccessDenied")}, false},
+		{&s3cache.StatusError{StatusCode: 400, Body: s3Error("InvalidArgument")}, false},
+	} {
+		st := memstore.New()
+		c := &s3cache.Cache{Store: st, MaxRetries: 1, RetryBaseDelay: time.Nanosecond}
+		c.Set("k", []byte("v"))
+		st.Fail("Get", 1, test.err)
+		_, ok, err := c.GetWithError("k")
+		if ok != test.retry || (err == nil) != test.retry {
+			t.Errorf("%d (%s): Get = %v, %v; want retried %v", test.err.StatusCode, test.err.Category(), ok, err, test.retry)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package s3cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sqs/s3"
+)
+
+// NewFromDefaultChain is like New, but the Cache obtains credentials as the
+// AWS SDKs do by default: from the environment, then from the shared
+// credentials and config files, then from the environment's IAM role. See
+// EnvCredentials, SharedCredentials and IAMCredentials.
+func NewFromDefaultChain(bucketURL string) *Cache {
+	c := New(bucketURL)
+	c.Credentials = &ChainCredentials{Providers: []CredentialsProvider{
+		EnvCredentials{},
+		&SharedCredentials{},
+		&IAMCredentials{},
+	}}
+	return c
+}
+
+// A ChainCredentials is a CredentialsProvider that obtains credentials from
+// the first of its Providers that has them. Once a provider has returned
+// credentials, it is used for all subsequent requests.
+//
+// A ChainCredentials is safe for concurrent use by multiple goroutines if its
+// Providers are.
+type ChainCredentials struct {
+	Providers []CredentialsProvider
+
+	mu       sync.Mutex
+	provider CredentialsProvider
+}
+
+// Keys implements CredentialsProvider.
+func (p *ChainCredentials) Keys(ctx context.Context) (*s3.Keys, error) {
+	p.mu.Lock()
+	provider := p.provider
+	p.mu.Unlock()
+	if provider != nil {
+		return provider.Keys(ctx)
+	}
+	var errs []string
+	for _, provider := range p.Providers {
+		keys, err := provider.Keys(ctx)
+		if err == nil && keys != nil && keys.AccessKey != "" {
+			p.mu.Lock()
+			p.provider = provider
+			p.mu.Unlock()
+			return keys, nil
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s (%s)", ErrCredentialsMissing, strings.Join(errs, "; "))
+	}
+	return nil, ErrCredentialsMissing
+}
+
+// EnvCredentials is a CredentialsProvider that obtains credentials from the
+// environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY (or
+// AWS_SECRET_KEY) and AWS_SESSION_TOKEN. It returns ErrCredentialsMissing if
+// they are unset.
+type EnvCredentials struct{}
+
+// Keys implements CredentialsProvider.
+func (EnvCredentials) Keys(ctx context.Context) (*s3.Keys, error) {
+	keys := &s3.Keys{
+		AccessKey:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:     os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SecurityToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if keys.SecretKey == "" {
+		keys.SecretKey = os.Getenv("AWS_SECRET_KEY")
+	}
+	if keys.AccessKey == "" || keys.SecretKey == "" {
+		return nil, ErrCredentialsMissing
+	}
+	return keys, nil
+}
+
+// SharedCredentials is a CredentialsProvider that obtains static credentials
+// for a profile from the shared AWS credentials file (~/.aws/credentials),
+// or failing that, from the shared AWS config file (~/.aws/config). The
+// files are read once, when credentials are first requested.
+//
+// A SharedCredentials is safe for concurrent use by multiple goroutines.
+type SharedCredentials struct {
+	// Filename is the path of the credentials file. If empty, the
+	// AWS_SHARED_CREDENTIALS_FILE environment variable is used, and if that
+	// is unset, ~/.aws/credentials.
+	Filename string
+
+	// ConfigFilename is the path of the config file. If empty, the
+	// AWS_CONFIG_FILE environment variable is used, and if that is unset,
+	// ~/.aws/config.
+	ConfigFilename string
+
+	// Profile is the name of the profile. If empty, the AWS_PROFILE
+	// environment variable is used, and if that is unset, "default".
+	Profile string
+
+	mu   sync.Mutex
+	keys *s3.Keys
+}
+
+// Keys implements CredentialsProvider.
+func (p *SharedCredentials) Keys(ctx context.Context) (*s3.Keys, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil {
+		return p.keys, nil
+	}
+	profile := firstNonEmpty(p.Profile, os.Getenv("AWS_PROFILE"), "default")
+	filename, err := awsFilename(p.Filename, "AWS_SHARED_CREDENTIALS_FILE", "credentials")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := readProfileKeys(filename, profile)
+	if err == nil && keys == nil {
+		// Profiles other than "default" are named "profile <name>" in the
+		// config file.
+		section := profile
+		if profile != "default" {
+			section = "profile " + profile
+		}
+		if filename, err = awsFilename(p.ConfigFilename, "AWS_CONFIG_FILE", "config"); err == nil {
+			keys, err = readProfileKeys(filename, section)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("s3cache: reading shared AWS credentials: %s", err)
+	}
+	if keys == nil {
+		return nil, ErrCredentialsMissing
+	}
+	p.keys = keys
+	return keys, nil
+}
+
+// awsFilename returns filename if it is set, and otherwise the value of the
+// environment variable env, or the file with the given name in ~/.aws.
+func awsFilename(filename, env, name string) (string, error) {
+	if filename = firstNonEmpty(filename, os.Getenv(env)); filename != "" {
+		return filename, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", name), nil
+}
+
+// readProfileKeys returns the credentials in the given section of the INI
+// file with the given name. It returns nil keys and a nil error if the file
+// or section does not exist or has no credentials.
+func readProfileKeys(filename, section string) (*s3.Keys, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys s3.Keys
+	var inSection bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[' && strings.HasSuffix(line, "]"):
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == section
+			continue
+		case !inSection:
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "aws_access_key_id":
+			keys.AccessKey = value
+		case "aws_secret_access_key":
+			keys.SecretKey = value
+		case "aws_session_token":
+			keys.SecurityToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keys.AccessKey == "" || keys.SecretKey == "" {
+		return nil, nil
+	}
+	return &keys, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
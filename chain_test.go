@@ -0,0 +1,226 @@
+package s3cache_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sqs/s3"
+	"sourcegraph.com/sourcegraph/s3cache"
+)
+
+// writeFile writes a file with the given name and contents in dir, and
+// returns its path.
+func writeFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clearAWSEnv unsets the environment variables that select AWS credentials
+// for the duration of the test, and points HOME at an empty directory.
+func clearAWSEnv(t *testing.T) {
+	for _, env := range []string{
+		"AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE",
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN",
+	} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("HOME", t.TempDir())
+}
+
+const testCredentials = `
+# A comment
+; Another comment
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+[work]
+aws_access_key_id=AKIDWORK
+aws_secret_access_key=work-secret
+aws_session_token = work-token
+
+[profile ignored]
+aws_access_key_id = AKIDIGNORED
+aws_secret_access_key = ignored-secret
+`
+
+const testConfig = `
+[default]
+region = us-west-2
+
+[ignored]
+aws_access_key_id = AKIDWRONG
+aws_secret_access_key = wrong-secret
+
+[profile ignored]
+aws_access_key_id = AKIDCONFIG
+aws_secret_access_key = config-secret
+
+[profile incomplete]
+aws_access_key_id = AKIDINCOMPLETE
+`
+
+func TestSharedCredentials(t *testing.T) {
+	clearAWSEnv(t)
+	dir := t.TempDir()
+	credentials := writeFile(t, dir, "credentials", testCredentials)
+	config := writeFile(t, dir, "config", testConfig)
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name    string
+		p       *s3cache.SharedCredentials
+		env     map[string]string
+		want    *s3.Keys // nil if none
+		wantErr error
+	}{
+		{
+			name: "default",
+			p:    &s3cache.SharedCredentials{Filename: credentials, ConfigFilename: config},
+			want: &s3.Keys{AccessKey: "AKIDDEFAULT", SecretKey: "default-secret"},
+		},
+		{
+			name: "Profile",
+			p:    &s3cache.SharedCredentials{Filename: credentials, ConfigFilename: config, Profile: "work"},
+			env:  map[string]string{"AWS_PROFILE": "default"},
+			want: &s3.Keys{AccessKey: "AKIDWORK", SecretKey: "work-secret", SecurityToken: "work-token"},
+		},
+		{
+			name: "AWS_PROFILE",
+			p:    &s3cache.SharedCredentials{Filename: credentials, ConfigFilename: config},
+			env:  map[string]string{"AWS_PROFILE": "work"},
+			want: &s3.Keys{AccessKey: "AKIDWORK", SecretKey: "work-secret", SecurityToken: "work-token"},
+		},
+		{
+			// The credentials file names profiles without "profile ", and
+			// the config file with it.
+			name: "profile in the config file",
+			p:    &s3cache.SharedCredentials{Filename: credentials, ConfigFilename: config, Profile: "ignored"},
+			want: &s3.Keys{AccessKey: "AKIDCONFIG", SecretKey: "config-secret"},
+		},
+		{
+			name: "environment overrides",
+			p:    &s3cache.SharedCredentials{Profile: "ignored"},
+			env:  map[string]string{"AWS_SHARED_CREDENTIALS_FILE": missing, "AWS_CONFIG_FILE": config},
+			want: &s3.Keys{AccessKey: "AKIDCONFIG", SecretKey: "config-secret"},
+		},
+		{
+			name: "AWS_SHARED_CREDENTIALS_FILE",
+			p:    &s3cache.SharedCredentials{},
+			env:  map[string]string{"AWS_SHARED_CREDENTIALS_FILE": credentials},
+			want: &s3.Keys{AccessKey: "AKIDDEFAULT", SecretKey: "default-secret"},
+		},
+		{
+			name:    "incomplete profile",
+			p:       &s3cache.SharedCredentials{Filename: credentials, ConfigFilename: config, Profile: "incomplete"},
+			wantErr: s3cache.ErrCredentialsMissing,
+		},
+		{
+			name:    "unknown profile",
+			p:       &s3cache.SharedCredentials{Filename: credentials, ConfigFilename: config, Profile: "unknown"},
+			wantErr: s3cache.ErrCredentialsMissing,
+		},
+		{
+			name:    "missing files",
+			p:       &s3cache.SharedCredentials{Filename: missing, ConfigFilename: missing},
+			wantErr: s3cache.ErrCredentialsMissing,
+		},
+		{
+			name:    "no files in HOME",
+			p:       &s3cache.SharedCredentials{},
+			wantErr: s3cache.ErrCredentialsMissing,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			keys, err := test.p.Keys(context.Background())
+			if test.wantErr != nil {
+				if keys != nil || !errors.Is(err, test.wantErr) {
+					t.Errorf("got %+v, %v; want %v", keys, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || *keys != *test.want {
+				t.Errorf("got %+v, %v; want %+v", keys, err, test.want)
+			}
+		})
+	}
+}
+
+func TestSharedCredentialsUnreadable(t *testing.T) {
+	clearAWSEnv(t)
+	// A directory cannot be read as a file.
+	p := &s3cache.SharedCredentials{Filename: t.TempDir()}
+	if keys, err := p.Keys(context.Background()); err == nil || errors.Is(err, s3cache.ErrCredentialsMissing) {
+		t.Errorf("got %+v, %v; want a read error", keys, err)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	clearAWSEnv(t)
+	if keys, err := (s3cache.EnvCredentials{}).Keys(context.Background()); err != s3cache.ErrCredentialsMissing {
+		t.Errorf("with no environment variables, got %+v, %v", keys, err)
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_KEY", "old-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+	want := s3.Keys{AccessKey: "AKIDENV", SecretKey: "old-secret", SecurityToken: "token"}
+	if keys, err := (s3cache.EnvCredentials{}).Keys(context.Background()); err != nil || *keys != want {
+		t.Errorf("got %+v, %v; want %+v", keys, err, want)
+	}
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	want.SecretKey = "secret"
+	if keys, err := (s3cache.EnvCredentials{}).Keys(context.Background()); err != nil || *keys != want {
+		t.Errorf("got %+v, %v; want %+v", keys, err, want)
+	}
+}
+
+// fakeProvider is a CredentialsProvider that returns keys, or err, and
+// counts its calls.
+type fakeProvider struct {
+	keys  *s3.Keys
+	err   error
+	calls int
+}
+
+func (p *fakeProvider) Keys(ctx context.Context) (*s3.Keys, error) {
+	p.calls++
+	return p.keys, p.err
+}
+
+func TestChainCredentials(t *testing.T) {
+	failing := &fakeProvider{err: errors.New("unavailable")}
+	empty := &fakeProvider{keys: &s3.Keys{}}
+	second := &fakeProvider{keys: &s3.Keys{AccessKey: "AKIDSECOND", SecretKey: "s"}}
+	third := &fakeProvider{keys: &s3.Keys{AccessKey: "AKIDTHIRD", SecretKey: "s"}}
+	p := &s3cache.ChainCredentials{Providers: []s3cache.CredentialsProvider{failing, empty, second, third}}
+
+	for i := 0; i < 3; i++ {
+		keys, err := p.Keys(context.Background())
+		if err != nil || keys.AccessKey != "AKIDSECOND" {
+			t.Fatalf("got %+v, %v; want the second provider's keys", keys, err)
+		}
+		// Once a provider has succeeded, the chain sticks to it, even if
+		// an earlier provider would now succeed.
+		failing.keys, failing.err = &s3.Keys{AccessKey: "AKIDFIRST", SecretKey: "s"}, nil
+	}
+	if failing.calls != 1 || empty.calls != 1 || second.calls != 3 || third.calls != 0 {
+		t.Errorf("providers called %d, %d, %d and %d times; want 1, 1, 3 and 0", failing.calls, empty.calls, second.calls, third.calls)
+	}
+
+	p = &s3cache.ChainCredentials{Providers: []s3cache.CredentialsProvider{&fakeProvider{err: errors.New("unavailable")}, &fakeProvider{}}}
+	want := s3cache.ErrCredentialsMissing.Error() + " (unavailable)"
+	if keys, err := p.Keys(context.Background()); keys != nil || err == nil || err.Error() != want {
+		t.Errorf("with no credentials, got %+v, %v; want %q", keys, err, want)
+	}
+}
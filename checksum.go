@@ -0,0 +1,44 @@
+package s3cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrChecksumMismatch is returned when reading a cache entry whose contents
+// do not match the checksum stored with it, and VerifyDownloads is set.
+var ErrChecksumMismatch = errors.New("s3cache: cache entry does not match its stored checksum")
+
+// checksumHeader is the header in which Set records the hex-encoded SHA-256
+// digest of a cache entry.
+const checksumHeader = "X-Amz-Meta-Sha256"
+
+func checksum(resp []byte) string {
+	sum := sha256.Sum256(resp)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyingReader is an io.ReadCloser that computes the SHA-256 digest of
+// the data read from it, and returns ErrChecksumMismatch instead of io.EOF
+// if the digest does not match the expected one.
+type verifyingReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	want string
+}
+
+func newVerifyingReader(rdr io.ReadCloser, want string) *verifyingReader {
+	return &verifyingReader{ReadCloser: rdr, h: sha256.New(), want: want}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.h.Sum(nil)) != r.want {
+		err = ErrChecksumMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,66 @@
+package s3cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// writeGroup tracks the writes in progress for each object key, so that
+// concurrent Sets of the same key can share a single upload.
+type writeGroup struct {
+	mu    sync.Mutex
+	calls map[string]*writeCall
+}
+
+// A writeCall is a write in progress, whose result is shared by the Sets of
+// the same key that wait for it.
+type writeCall struct {
+	done chan struct{} // closed when err is set
+	err  error
+}
+
+// coalesceWrite calls write to store the object with the given key, unless
+// CoalesceWrites is set and another write of the key is in progress, in
+// which case it waits for that write and returns its error instead. It
+// returns the number of bytes written by write, which is zero if it shared
+// another write.
+func (c *Cache) coalesceWrite(ctx context.Context, objectKey string, write func() (int, error)) (int, error) {
+	if !c.CoalesceWrites {
+		return write()
+	}
+	g := &c.writes
+	for {
+		g.mu.Lock()
+		call := g.calls[objectKey]
+		if call == nil {
+			break
+		}
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		// If the write was abandoned by its caller, write the entry
+		// again rather than reporting another caller's cancellation.
+		if !errors.Is(call.err, context.Canceled) && !errors.Is(call.err, context.DeadlineExceeded) {
+			return 0, call.err
+		}
+	}
+	call := &writeCall{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = make(map[string]*writeCall)
+	}
+	g.calls[objectKey] = call
+	g.mu.Unlock()
+
+	n, err := write()
+
+	g.mu.Lock()
+	delete(g.calls, objectKey)
+	call.err = err
+	g.mu.Unlock()
+	close(call.done)
+	return n, err
+}
@@ -0,0 +1,151 @@
+package s3cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressionHeader records the codec with which Set compressed the object
+// of a cache entry, so that Get can decompress it whatever the Cache's
+// current settings.
+const compressionHeader = "X-Amz-Meta-Compression"
+
+// Compression codecs recorded in compressionHeader. A codec without built-in
+// support, such as "zstd", is decompressed with the Cache's Decoders.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// compression returns the codec of the object with the header h. Objects
+// written before the codec was recorded are gzipped if Gzip is set or they
+// have a gzip Content-Encoding, or have only their body gzipped if they
+// have a gzipBodyHeader.
+func (c *Cache) compression(h http.Header) string {
+	if codec := h.Get(compressionHeader); codec != "" {
+		return codec
+	}
+	if c.Gzip || h.Get("Content-Encoding") == "gzip" || h.Get(gzipBodyHeader) != "" {
+		return compressionGzip
+	}
+	return compressionNone
+}
+
+// decompress returns a reader that decompresses body, the object with the
+// header h, according to its codec.
+func (c *Cache) decompress(body io.ReadCloser, h http.Header) (io.ReadCloser, error) {
+	switch codec := c.compression(h); codec {
+	case compressionNone:
+		return body, nil
+	case compressionGzip:
+		if n, err := strconv.ParseInt(h.Get(gzipBodyHeader), 10, 64); err == nil && n >= 0 {
+			return gunzipBody(body, n)
+		}
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		return &gzipReader{Reader: zr, body: body}, nil
+	default:
+		dec := c.Decoders[codec]
+		if dec == nil {
+			body.Close()
+			return nil, fmt.Errorf("s3cache: no decoder for compression %q", codec)
+		}
+		r, err := dec(body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, body}, nil
+	}
+}
+
+// sniffLen is the number of bytes of a cache entry's content examined to
+// determine whether it is already compressed.
+const sniffLen = 512
+
+// worthCompressing reports whether Set should compress resp when Compress
+// is set: always, unless CompressMinSize is positive, in which case only if
+// resp is at least CompressMinSize bytes long and its content does not
+// appear to be compressed already.
+func (c *Cache) worthCompressing(resp []byte) bool {
+	if c.CompressMinSize <= 0 {
+		return true
+	}
+	return len(resp) >= c.CompressMinSize && !precompressed(resp)
+}
+
+// precompressed reports whether the content of the cache entry resp, or of
+// its body if it is a serialized HTTP response, is already compressed, as
+// indicated by its Content-Encoding or its magic bytes.
+func precompressed(resp []byte) bool {
+	content := resp
+	if bytes.HasPrefix(resp, []byte("HTTP/")) {
+		r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+		if err != nil {
+			return false
+		}
+		defer r.Body.Close()
+		if ce := r.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+			return true
+		}
+		if content, err = ioutil.ReadAll(&io.LimitedReader{R: r.Body, N: sniffLen}); err != nil {
+			return false
+		}
+	}
+	switch ct := http.DetectContentType(content); {
+	case strings.HasPrefix(ct, "image/") && ct != "image/bmp" && ct != "image/x-icon",
+		strings.HasPrefix(ct, "audio/"), strings.HasPrefix(ct, "video/"),
+		strings.HasPrefix(ct, "font/woff"),
+		ct == "application/x-gzip", ct == "application/zip", ct == "application/x-rar-compressed",
+		ct == "application/pdf":
+		return true
+	}
+	// Formats that http.DetectContentType does not recognize.
+	for _, magic := range []string{
+		"\x28\xb5\x2f\xfd",   // zstd
+		"BZh",                // bzip2
+		"\xfd7zXZ\x00",       // xz
+		"7z\xbc\xaf\x27\x1c", // 7-Zip
+		"\x04\x22\x4d\x18",   // LZ4
+	} {
+		if bytes.HasPrefix(content, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriters pools gzip writers, each of which allocates hundreds of
+// kilobytes of compression state. The buffers into which entries are
+// compressed are not pooled, since the HTTP transport may still be reading
+// a request body after the request has returned.
+var gzipWriters sync.Pool
+
+// getGzipWriter returns a gzip writer that compresses to w, which should be
+// returned with putGzipWriter once closed.
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	if gw, ok := gzipWriters.Get().(*gzip.Writer); ok {
+		gw.Reset(w)
+		return gw
+	}
+	return gzip.NewWriter(w)
+}
+
+func putGzipWriter(gw *gzip.Writer) {
+	gw.Reset(nil)
+	gzipWriters.Put(gw)
+}
@@ -0,0 +1,138 @@
+package s3cache_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// compressionSettings are the ways in which a Cache can compress entries.
+var compressionSettings = []struct {
+	name string
+	set  func(*s3cache.Cache)
+}{
+	{"none", func(*s3cache.Cache) {}},
+	{"Compress", func(c *s3cache.Cache) { c.Compress = true }},
+	{"CompressBody", func(c *s3cache.Cache) { c.CompressBody = true }},
+	{"Gzip", func(c *s3cache.Cache) { c.Gzip = true }},
+}
+
+// jsonResponse is a serialized HTTP response with a JSON body of about
+// 64 KB, which compresses about as well as typical API responses.
+var jsonResponse = func() []byte {
+	var body bytes.Buffer
+	body.WriteString("[")
+	for i := 0; body.Len() < 64<<10; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"id":%d,"login":"user%x","score":%d,"url":"https://example.com/users/%d"}`, i, i*2654435761, i*7919%1000, i)
+	}
+	body.WriteString("]")
+	return append([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", body.Len())), body.Bytes()...)
+}()
+
+// storedSize returns the total size of the objects in c's bucket.
+func storedSize(tb testing.TB, c *s3cache.Cache) int64 {
+	objects, err := c.List()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var n int64
+	for _, o := range objects {
+		n += o.Size
+	}
+	return n
+}
+
+func TestCompressSize(t *testing.T) {
+	for _, s := range compressionSettings {
+		c := &s3cache.Cache{Store: memstore.New()}
+		s.set(c)
+		c.Set("k", jsonResponse)
+		n := storedSize(t, c)
+		if s.name == "none" {
+			if n != int64(len(jsonResponse)) {
+				t.Errorf("%s: stored %d bytes, want %d", s.name, n, len(jsonResponse))
+			}
+		} else if n >= int64(len(jsonResponse))/2 {
+			t.Errorf("%s: stored %d bytes for a %d-byte response", s.name, n, len(jsonResponse))
+		}
+		if resp, ok := c.Get("k"); !ok || !bytes.Equal(resp, jsonResponse) {
+			t.Errorf("%s: Get returned %d bytes, %v", s.name, len(resp), ok)
+		}
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte("a"), 4096)...)
+	gz := gzipped(t, jsonResponse)
+	tests := []struct {
+		name       string
+		resp       []byte
+		compressed bool
+	}{
+		{"plaintext", jsonResponse, true},
+		{"small plaintext", []byte(`{"a":"b"}`), false},
+		{"incompressible", random, false},
+		{"gzip", append(gz, bytes.Repeat([]byte("a"), 4096)...), false},
+		{"PNG", png, false},
+		{"PNG response", append([]byte("HTTP/1.1 200 OK\r\nContent-Type: image/png\r\n\r\n"), png...), false},
+		{"gzip-encoded response", append([]byte("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n"), bytes.Repeat([]byte("a"), 4096)...), false},
+		{"zstd", append([]byte("\x28\xb5\x2f\xfd"), bytes.Repeat([]byte("a"), 4096)...), false},
+	}
+	for _, test := range tests {
+		for _, body := range []bool{false, true} {
+			c := &s3cache.Cache{Store: memstore.New(), Compress: true, CompressBody: body, CompressMinSize: 1024}
+			c.Set("k", test.resp)
+			n := storedSize(t, c)
+			if compressed := n < int64(len(test.resp)); compressed != test.compressed {
+				t.Errorf("%s (CompressBody %v): stored %d bytes of %d, want compressed %v", test.name, body, n, len(test.resp), test.compressed)
+			}
+			if resp, ok := c.Get("k"); !ok || !bytes.Equal(resp, test.resp) {
+				t.Errorf("%s (CompressBody %v): Get returned %d bytes, %v", test.name, body, len(resp), ok)
+			}
+		}
+	}
+}
+
+// BenchmarkCompression measures the CPU cost of each compression setting,
+// and reports the size of the stored object as stored-B/op.
+func BenchmarkCompression(b *testing.B) {
+	for _, s := range compressionSettings {
+		b.Run(s.name+"/Set", func(b *testing.B) {
+			c := &s3cache.Cache{Store: memstore.New()}
+			s.set(c)
+			b.SetBytes(int64(len(jsonResponse)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.Set("k"+strconv.Itoa(i%100), jsonResponse)
+			}
+			b.StopTimer()
+			c = &s3cache.Cache{Store: memstore.New()}
+			s.set(c)
+			c.Set("k", jsonResponse)
+			b.ReportMetric(float64(storedSize(b, c)), "stored-B/op")
+		})
+		b.Run(s.name+"/Get", func(b *testing.B) {
+			c := &s3cache.Cache{Store: memstore.New()}
+			s.set(c)
+			c.Set("k", jsonResponse)
+			b.SetBytes(int64(len(jsonResponse)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := c.Get("k"); !ok {
+					b.Fatal("miss")
+				}
+			}
+		})
+	}
+}
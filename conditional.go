@@ -0,0 +1,49 @@
+package s3cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// GetIfModifiedSince is like GetWithError, but it downloads the cache entry
+// for key only if it has been stored since t, using a conditional
+// (If-Modified-Since) request. If the entry exists but has not been stored
+// since t, modified is false, ok is true and resp is nil. If no entry
+// exists, both modified and ok are false. Otherwise, resp is the entry and
+// both modified and ok are true.
+//
+// S3 compares t with the time the entry was stored at the granularity of a
+// second.
+func (c *Cache) GetIfModifiedSince(key string, t time.Time) (resp []byte, modified, ok bool, err error) {
+	ctx := context.Background()
+	h := http.Header{"If-Modified-Since": {t.UTC().Format(http.TimeFormat)}}
+	err = c.retry(ctx, "Get", key, func() error {
+		resp, _, ok, err = c.get(ctx, key, h)
+		return err
+	})
+	switch {
+	case notModified(err):
+		c.onHit(key)
+		return nil, false, true, nil
+	case errors.Is(err, ErrNegativeCached):
+		c.onMiss(key)
+	case skipped(err):
+		c.onSkip("Get", key, err)
+	case err != nil:
+		c.onError("Get", key, err)
+	case ok:
+		c.onHit(key)
+	default:
+		c.onMiss(key)
+	}
+	return resp, ok, ok, c.wrapError("Get", key, err)
+}
+
+// notModified reports whether err is the response to a conditional request
+// whose condition was not met because the object has not been modified.
+func notModified(err error) bool {
+	var e *StatusError
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotModified
+}
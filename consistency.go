@@ -0,0 +1,103 @@
+package s3cache
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrStaleRead is returned by Get when ConsistentReads is set and S3 returns
+// an older version of a cache entry than the one recently stored by Set.
+var ErrStaleRead = errors.New("s3cache: S3 returned a stale cache entry")
+
+// etagCache holds the ETags of objects recently written by a Cache, if they
+// are known.
+type etagCache struct {
+	mu        sync.Mutex
+	etags     map[string]etagEntry // by object key
+	lastSweep time.Time
+}
+
+type etagEntry struct {
+	etag    string
+	written time.Time
+}
+
+func (c *Cache) consistencyWindow() time.Duration {
+	if c.ConsistencyWindow <= 0 {
+		return 5 * time.Second
+	}
+	return c.ConsistencyWindow
+}
+
+// recordWrite records that body was stored in the object with the given
+// key, so that Get can recognize stale versions of it and retry reads of it
+// that find no object.
+func (c *Cache) recordWrite(objectKey string, body []byte) {
+	if !c.ConsistentReads && c.ReadAfterWriteRetries <= 0 {
+		return
+	}
+	var etag string
+	// Unless the object was stored in a single PUT request without SSE-KMS
+	// or SSE-C, its ETag is not the MD5 digest of its body.
+	if c.ConsistentReads && !c.multipart(int64(len(body))) && c.ServerSideEncryption != "aws:kms" && len(c.SSECustomerKey) == 0 {
+		sum := md5.Sum(body)
+		etag = `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+	now := c.now()
+	window := c.consistencyWindow()
+	e := &c.etags
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.etags == nil {
+		e.etags = make(map[string]etagEntry)
+	}
+	if now.Sub(e.lastSweep) > window {
+		for k, v := range e.etags {
+			if now.Sub(v.written) > window {
+				delete(e.etags, k)
+			}
+		}
+		e.lastSweep = now
+	}
+	e.etags[objectKey] = etagEntry{etag: etag, written: now}
+}
+
+// forgetWrite forgets the recent write of the object with the given key,
+// which is being deleted.
+func (c *Cache) forgetWrite(objectKey string) {
+	e := &c.etags
+	e.mu.Lock()
+	delete(e.etags, objectKey)
+	e.mu.Unlock()
+}
+
+// recentlyWritten reports whether c wrote the object with the given key
+// within the consistency window.
+func (c *Cache) recentlyWritten(objectKey string) bool {
+	e := &c.etags
+	e.mu.Lock()
+	entry, ok := e.etags[objectKey]
+	e.mu.Unlock()
+	return ok && c.now().Sub(entry.written) <= c.consistencyWindow()
+}
+
+// stale reports whether h, the header of the object with the given key,
+// shows that the object is not the version recently written by c.
+func (c *Cache) stale(objectKey string, h http.Header) bool {
+	if !c.ConsistentReads {
+		return false
+	}
+	e := &c.etags
+	e.mu.Lock()
+	entry, ok := e.etags[objectKey]
+	e.mu.Unlock()
+	if !ok || entry.etag == "" || c.now().Sub(entry.written) > c.consistencyWindow() {
+		return false
+	}
+	etag := h.Get("Etag")
+	return etag != "" && etag != entry.etag
+}
@@ -0,0 +1,180 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrCrossRegionCopy is returned by CopyFrom when the source and destination
+// caches are in buckets in different AWS regions, which S3 server-side
+// copies do not support from a single regional endpoint.
+var ErrCrossRegionCopy = errors.New("s3cache: cannot copy between buckets in different regions")
+
+// CopyFrom copies the cache entry for key from src to c, without downloading
+// it, using an S3 server-side copy. src may use a different bucket, in the
+// same account and region, or a different Prefix or KeyFunc. The request is
+// signed with c's credentials, which must be allowed to read from src's
+// bucket. The entry keeps its metadata and age; c's storage class,
+// encryption and ACL settings apply to the copy. If the entry is
+// deduplicated (see Dedup), its blob is copied too, unless c already has it.
+//
+// If either cache has a Store, the entry is instead copied by reading it
+// from src's Store and writing it to c's.
+func (c *Cache) CopyFrom(src *Cache, key string) error {
+	err := c.copyFrom(context.Background(), src, key)
+	c.setDone(key, err)
+	return c.wrapError("Copy", key, err)
+}
+
+func (c *Cache) copyFrom(ctx context.Context, src *Cache, key string) error {
+	if err := c.permit("Copy"); err != nil {
+		return err
+	}
+	if src.Gzip != c.Gzip {
+		return errors.New("s3cache: cannot copy between caches with different Gzip settings")
+	}
+	srcKey, dstKey := src.ObjectKey(key), c.ObjectKey(key)
+	sh, err := src.store().Head(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if sum := sh.Get(blobHeader); sum != "" {
+		// The entry is a pointer to a blob (see Dedup), which it names by
+		// digest, so copy the blob under c's Prefix, unless c has it.
+		blobKey := c.blobKey(sum)
+		bh, err := c.store().Head(ctx, blobKey)
+		if err != nil {
+			return err
+		}
+		if bh == nil {
+			if err := c.copyObject(ctx, src, key, src.blobKey(sum), blobKey); err != nil {
+				return err
+			}
+		}
+	}
+	return c.copyObject(ctx, src, key, srcKey, dstKey)
+}
+
+// copyObject copies the object with the key srcKey in src's bucket to dstKey
+// in c's, as part of copying the cache entry for key.
+func (c *Cache) copyObject(ctx context.Context, src *Cache, key, srcKey, dstKey string) error {
+	if c.Store != nil || src.Store != nil {
+		return c.copyThrough(ctx, src, srcKey, dstKey)
+	}
+	if src.region() != c.region() {
+		return ErrCrossRegionCopy
+	}
+	source, err := src.copySource(srcKey)
+	if err != nil {
+		return err
+	}
+	h := c.uploadHeader()
+	for k := range h {
+		if k == "Content-Encoding" || k == "Content-Type" || k == "Expires" || k == "If-None-Match" || k == "X-Amz-Tagging" || strings.HasPrefix(k, "X-Amz-Meta-") {
+			h.Del(k)
+		}
+	}
+	h.Set("X-Amz-Copy-Source", source)
+	return c.retry(ctx, "Copy", key, func() error {
+		req, err := c.newObjectRequest("PUT", dstKey, "", nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		c.setSSECustomer(req.Header, "X-Amz-")
+		src.setSSECustomer(req.Header, "X-Amz-Copy-Source-")
+		resp, err := c.do(ctx, req)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+		// S3 may report that a copy failed in the body of a 200 response.
+		// Such failures are to be retried like 5xx responses.
+		if bytes.Contains(body, []byte("<Error>")) {
+			return &StatusError{StatusCode: http.StatusInternalServerError, Body: string(body)}
+		}
+		return nil
+	})
+}
+
+// copyThrough copies an entry from src's Store to c's by reading it and
+// writing it back.
+func (c *Cache) copyThrough(ctx context.Context, src *Cache, srcKey, dstKey string) error {
+	body, sh, err := src.store().Get(ctx, srcKey, nil)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return fmt.Errorf("s3cache: no cache entry to copy at %q", srcKey)
+	}
+	defer body.Close()
+	h := c.uploadHeader()
+	h.Del("Content-Encoding")
+	h.Del("Content-Type")
+	for k, v := range sh {
+		if k == "Content-Encoding" || k == "Content-Type" || strings.HasPrefix(k, "X-Amz-Meta-") {
+			h[k] = v
+		}
+	}
+	size, err := strconv.ParseInt(sh.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	return c.ignoreExisting(c.store().Put(ctx, dstKey, body, size, h))
+}
+
+// copySource returns the value of the X-Amz-Copy-Source header that refers
+// to the object with the given key in c's bucket, which is of the form
+// "/bucket/key", or "<access point ARN>/object/key" for access points.
+func (c *Cache) copySource(objectKey string) (string, error) {
+	u, err := c.objectURL(objectKey, "")
+	if err != nil {
+		return "", err
+	}
+	path := u.EscapedPath()
+	if arn, ok := accessPointARN(u.Hostname()); ok {
+		// Objects are copied from an access point by its ARN.
+		return arn + "/object" + path, nil
+	}
+	if !c.Accelerate && (c.PathStyle || isPathStyleAmazonHost(u.Hostname())) {
+		return path, nil
+	}
+	bucket := bucketFromHost(u.Hostname())
+	if bucket == "" {
+		return "", fmt.Errorf("s3cache: cannot determine bucket name from URL %q", c.BucketURL)
+	}
+	return "/" + bucket + path, nil
+}
+
+// bucketFromHost returns the bucket name in a virtual-hosted-style S3 host,
+// such as "mybucket" in "mybucket.s3.us-west-2.amazonaws.com". For hosts
+// other than Amazon S3 endpoints, it returns the host's first label.
+func bucketFromHost(host string) string {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".amazonaws.com") {
+		return strings.SplitN(host, ".", 2)[0]
+	}
+	labels := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	for i := len(labels) - 1; i > 0; i-- {
+		if labels[i] == "s3" || strings.HasPrefix(labels[i], "s3-") {
+			return strings.Join(labels[:i], ".")
+		}
+	}
+	return ""
+}
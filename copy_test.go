@@ -0,0 +1,34 @@
+package s3cache_test
+
+import (
+	"bytes"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func TestCopyFromDedup(t *testing.T) {
+	for _, dstDedup := range []bool{true, false} {
+		src := &s3cache.Cache{Store: memstore.New(), Prefix: "src", Dedup: true}
+		dstStore := memstore.New()
+		dst := &s3cache.Cache{Store: dstStore, Prefix: "dst", Dedup: dstDedup}
+		resp := []byte("shared response")
+		for _, key := range []string{"a", "b"} {
+			if err := src.SetWithError(key, resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.CopyFrom(src, key); err != nil {
+				t.Fatalf("CopyFrom(%q): %v", key, err)
+			}
+			got, ok, err := dst.GetWithError(key)
+			if err != nil || !ok || !bytes.Equal(got, resp) {
+				t.Errorf("dst Dedup=%v: Get(%q) = %q, %v, %v; want the copied entry", dstDedup, key, got, ok, err)
+			}
+		}
+		// Two pointers, and the one blob they share.
+		if n := dstStore.Len(); n != 3 {
+			t.Errorf("dst Dedup=%v: dst has %d objects, want 3", dstDedup, n)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package s3cache
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sqs/s3"
+)
+
+// A CredentialsProvider provides the AWS credentials used to sign requests
+// to S3.
+type CredentialsProvider interface {
+	// Keys returns the current credentials. It is called for every
+	// request, so implementations that fetch credentials remotely should
+	// cache them.
+	Keys(ctx context.Context) (*s3.Keys, error)
+}
+
+// ErrCredentialsMissing is returned when a Cache has no AWS credentials with
+// which to sign requests and is not configured for anonymous access.
+var ErrCredentialsMissing = errors.New("s3cache: AWS credentials are missing (set AWS_ACCESS_KEY_ID and AWS_SECRET_KEY, or set Anonymous for public buckets)")
+
+// ErrAnonymousWrite is returned by operations that would modify the bucket
+// of an anonymous Cache, which can only read public objects.
+var ErrAnonymousWrite = errors.New("s3cache: cannot write to S3 anonymously")
+
+// SetCredentials sets the AWS credentials used to sign subsequent requests,
+// in place of Config.Keys and Credentials, e.g. to rotate access keys at
+// runtime. It is safe to call concurrently with other operations: requests
+// already signed, including those in flight, keep the credentials that were
+// current when they were signed.
+func (c *Cache) SetCredentials(accessKey, secretKey string) {
+	c.rotated.Store(&s3.Keys{AccessKey: accessKey, SecretKey: secretKey})
+}
+
+// keys returns the credentials used to sign requests: those set by
+// SetCredentials, if any, or else those of the Cache's Credentials provider
+// if it is set, and Config.Keys otherwise. It returns ErrCredentialsMissing
+// if there are none, unless the Cache is anonymous.
+func (c *Cache) keys(ctx context.Context) (*s3.Keys, error) {
+	keys := c.Config.Keys
+	if rotated := c.rotated.Load(); rotated != nil {
+		keys = rotated
+	} else if c.Credentials != nil {
+		var err error
+		if keys, err = c.Credentials.Keys(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if keys == nil {
+		keys = &s3.Keys{}
+	}
+	if keys.AccessKey == "" && !c.Anonymous {
+		return nil, ErrCredentialsMissing
+	}
+	return keys, nil
+}
+
+// NewStrict is like NewValidated, but it also returns ErrCredentialsMissing
+// if the AWS credentials environment variables are unset.
+func NewStrict(bucketURL string) (*Cache, error) {
+	c, err := NewValidated(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if c.Config.Keys.AccessKey == "" || c.Config.Keys.SecretKey == "" {
+		return nil, ErrCredentialsMissing
+	}
+	return c, nil
+}
+
+// NewFromIAM is like New, but the Cache obtains temporary credentials from
+// the environment's IAM role using IAMCredentials, instead of using static
+// keys.
+func NewFromIAM(bucketURL string) *Cache {
+	c := New(bucketURL)
+	c.Credentials = &IAMCredentials{}
+	return c
+}
+
+// IAMCredentials is a CredentialsProvider that obtains temporary credentials
+// for an IAM role. It uses, in order of preference:
+//
+//   - a web identity token (e.g., EKS IAM roles for service accounts), if
+//     AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN are set;
+//   - the ECS container credentials endpoint, if
+//     AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+//     AWS_CONTAINER_CREDENTIALS_FULL_URI is set;
+//   - the EC2 instance metadata service.
+//
+// Credentials are cached and refreshed shortly before they expire. Only one
+// refresh is made at a time: while it is in progress, other callers use the
+// cached credentials if they are still valid, and otherwise wait for its
+// result. If a refresh fails while the cached credentials are still valid,
+// the cached credentials continue to be used.
+//
+// An IAMCredentials is safe for concurrent use by multiple goroutines.
+type IAMCredentials struct {
+	// Client is used for requests to the credentials endpoints. If nil, an
+	// HTTP client with a 5-second timeout is used.
+	Client *http.Client
+
+	mu       sync.Mutex
+	current  *s3.Keys
+	expires  time.Time
+	refresh  time.Time        // when to start refreshing current
+	inflight *credentialsCall // the refresh in progress, if any
+}
+
+// A credentialsCall is a refresh of IAMCredentials, whose result is shared
+// by the callers of Keys that wait for it.
+type credentialsCall struct {
+	done chan struct{} // closed when keys and err are set
+	keys *s3.Keys
+	err  error
+}
+
+// Keys implements CredentialsProvider.
+func (p *IAMCredentials) Keys(ctx context.Context) (*s3.Keys, error) {
+	p.mu.Lock()
+	now := time.Now()
+	if p.current != nil && now.Before(p.refresh) {
+		keys := p.current
+		p.mu.Unlock()
+		return keys, nil
+	}
+	if call := p.inflight; call != nil {
+		keys, valid := p.current, p.current != nil && now.Before(p.expires)
+		p.mu.Unlock()
+		if valid {
+			return keys, nil
+		}
+		select {
+		case <-call.done:
+			return call.keys, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &credentialsCall{done: make(chan struct{})}
+	p.inflight = call
+	p.mu.Unlock()
+
+	// The result is shared with other callers, so it must not depend on
+	// whether this caller's ctx is cancelled.
+	keys, expires, err := p.retrieve(context.WithoutCancel(ctx))
+
+	p.mu.Lock()
+	now = time.Now()
+	switch {
+	case err == nil:
+		p.current, p.expires = keys, expires
+		// Refresh when a quarter of the credentials' lifetime remains, but
+		// no earlier than 5 minutes before expiry, so that short-lived STS
+		// tokens are not refreshed on every request.
+		window := expires.Sub(now) / 4
+		if window > 5*time.Minute {
+			window = 5 * time.Minute
+		}
+		p.refresh = expires.Add(-window)
+	case p.current != nil && now.Before(p.expires):
+		keys, err = p.current, nil
+	default:
+		keys, err = nil, fmt.Errorf("s3cache: retrieving IAM credentials: %s", err)
+	}
+	p.inflight = nil
+	call.keys, call.err = keys, err
+	p.mu.Unlock()
+	close(call.done)
+	return keys, err
+}
+
+func (p *IAMCredentials) retrieve(ctx context.Context) (*s3.Keys, time.Time, error) {
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+		return p.retrieveWebIdentity(ctx)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return p.retrieveJSON(ctx, "http://169.254.170.2"+uri, nil)
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		var h http.Header
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			h = http.Header{"Authorization": {token}}
+		}
+		return p.retrieveJSON(ctx, uri, h)
+	}
+	return p.retrieveEC2(ctx)
+}
+
+const ec2MetadataURL = "http://169.254.169.254/latest"
+
+// retrieveEC2 obtains the credentials of the instance's IAM role from the
+// EC2 instance metadata service, using IMDSv2 if it is available.
+func (p *IAMCredentials) retrieveEC2(ctx context.Context) (*s3.Keys, time.Time, error) {
+	h := make(http.Header)
+	req, err := http.NewRequest("PUT", ec2MetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	if token, err := p.fetch(ctx, req); err == nil {
+		h.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	}
+
+	req, err = http.NewRequest("GET", ec2MetadataURL+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header = h
+	roles, err := p.fetch(ctx, req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, time.Time{}, errors.New("no IAM role is associated with the instance")
+	}
+	return p.retrieveJSON(ctx, ec2MetadataURL+"/meta-data/iam/security-credentials/"+role, h)
+}
+
+// retrieveJSON obtains credentials from the EC2 or ECS credentials endpoint
+// at url.
+func (p *IAMCredentials) retrieveJSON(ctx context.Context, url string, h http.Header) (*s3.Keys, time.Time, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if h != nil {
+		req.Header = h
+	}
+	body, err := p.fetch(ctx, req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return nil, time.Time{}, err
+	}
+	keys := &s3.Keys{
+		AccessKey:     creds.AccessKeyID,
+		SecretKey:     creds.SecretAccessKey,
+		SecurityToken: creds.Token,
+	}
+	return keys, creds.Expiration, nil
+}
+
+// retrieveWebIdentity exchanges the web identity token in
+// AWS_WEB_IDENTITY_TOKEN_FILE for credentials for the role AWS_ROLE_ARN,
+// using STS AssumeRoleWithWebIdentity.
+func (p *IAMCredentials) retrieveWebIdentity(ctx context.Context) (*s3.Keys, time.Time, error) {
+	token, err := ioutil.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("s3cache-%d", time.Now().UnixNano())
+	}
+	endpoint := "https://sts.amazonaws.com/"
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		endpoint = "https://sts." + region + ".amazonaws.com/"
+	}
+	q := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest("GET", endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	body, err := p.fetch(ctx, req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return nil, time.Time{}, err
+	}
+	keys := &s3.Keys{
+		AccessKey:     resp.Credentials.AccessKeyID,
+		SecretKey:     resp.Credentials.SecretAccessKey,
+		SecurityToken: resp.Credentials.SessionToken,
+	}
+	return keys, resp.Credentials.Expiration, nil
+}
+
+// fetch sends req and returns the response body, or an error if the
+// response status is not 200 OK.
+func (p *IAMCredentials) fetch(ctx context.Context, req *http.Request) ([]byte, error) {
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
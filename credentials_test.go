@@ -0,0 +1,120 @@
+package s3cache_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+)
+
+// accessKey returns the access key with which req was signed.
+func accessKey(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	i := strings.Index(auth, "Credential=")
+	if i < 0 {
+		return ""
+	}
+	return strings.SplitN(auth[i+len("Credential="):], "/", 2)[0]
+}
+
+// TestSetCredentials checks that credentials can be rotated while requests
+// are in flight, and that subsequent requests use the new credentials.
+func TestSetCredentials(t *testing.T) {
+	_, c := newFakeS3(t)
+	var (
+		mu   sync.Mutex
+		used = make(map[string]bool)
+	)
+	c.RequestHook = func(req *http.Request) error {
+		mu.Lock()
+		used[accessKey(req)] = true
+		mu.Unlock()
+		return nil
+	}
+	c.Set("k", []byte("v"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if resp, ok := c.Get("k"); !ok || string(resp) != "v" {
+				t.Errorf("Get = %q, %v; want the entry", resp, ok)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			c.SetCredentials("AKID"+strconv.Itoa(i), "secret")
+		}(i)
+	}
+	wg.Wait()
+	for key := range used {
+		if !strings.HasPrefix(key, "AKID") {
+			t.Errorf("request signed with unexpected access key %q", key)
+		}
+	}
+
+	c.SetCredentials("AKIDLAST", "secret")
+	mu.Lock()
+	used = make(map[string]bool)
+	mu.Unlock()
+	c.Get("k")
+	if len(used) != 1 || !used["AKIDLAST"] {
+		t.Errorf("after SetCredentials, requests were signed with %v; want AKIDLAST", used)
+	}
+}
+
+// TestIAMCredentialsSingleRefresh checks that concurrent callers of Keys
+// share a single fetch of the credentials.
+func TestIAMCredentialsSingleRefresh(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		// Respond slowly, so that the other callers arrive during the
+		// fetch.
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"AccessKeyId":"AKIDIAM","SecretAccessKey":"secret","Token":"session","Expiration":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL)
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "token")
+
+	p := &s3cache.IAMCredentials{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := p.Keys(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if keys.AccessKey != "AKIDIAM" || keys.SecretKey != "secret" || keys.SecurityToken != "session" {
+				t.Errorf("got keys %+v", keys)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := p.Keys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("credentials were fetched %d times, want once", n)
+	}
+}
@@ -0,0 +1,134 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobHeader is the header of a pointer object written by Set when Dedup is
+// set, which holds the SHA-256 digest of the cache entry stored in the blob
+// object to which it points.
+const blobHeader = "X-Amz-Meta-S3cache-Blob"
+
+// blobDir is the directory, under Prefix, that holds the blob objects of
+// deduplicated cache entries.
+const blobDir = "blobs/"
+
+// blobKey returns the object key of the blob holding cache entries with the
+// given hex-encoded SHA-256 digest.
+func (c *Cache) blobKey(sum string) string {
+	key := c.keyPrefix() + blobDir + sum
+	if c.Gzip {
+		key += ".gz"
+	}
+	return key
+}
+
+// isBlobKey reports whether objectKey is the key of a blob object.
+func (c *Cache) isBlobKey(objectKey string) bool {
+	return strings.HasPrefix(objectKey, c.keyPrefix()+blobDir)
+}
+
+// putDedup stores resp in the blob object named by its digest, unless one
+// already exists, and stores a pointer to the blob in the object with the
+// given key. It returns the number of bytes written.
+func (c *Cache) putDedup(ctx context.Context, key, objectKey string, resp []byte, opts *SetOptions) (int, error) {
+	sum := checksum(resp)
+	blobKey := c.blobKey(sum)
+	h, err := c.store().Head(ctx, blobKey)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if h == nil {
+		// Blobs are shared by entries, so they have no provenance.
+		if n, err = c.putObject(ctx, "", blobKey, resp, opts); err != nil {
+			return 0, err
+		}
+	}
+	ph := c.uploadHeader()
+	c.setProvenance(ph, key)
+	ph.Del("Content-Encoding")
+	ph.Set(blobHeader, sum)
+	rh := responseHeader(resp)
+	c.setFreshness(ph, rh)
+	setEncoding(ph, rh)
+	opts.apply(ph)
+	if err := c.store().Put(ctx, objectKey, bytes.NewReader(nil), 0, ph); err != nil {
+		return n, c.ignoreExisting(err)
+	}
+	c.recordWrite(objectKey, nil)
+	return n, nil
+}
+
+// CollectBlobs deletes the blob objects of deduplicated cache entries (see
+// Dedup) to which no cache entry points, if they were written more than
+// minAge ago. Deleting cache entries does not delete their blobs, which may
+// be shared with other entries, so CollectBlobs should be called
+// periodically when Dedup is set. minAge protects blobs being written by
+// concurrent calls to Set; an entry whose blob is deleted nonetheless is
+// treated as a miss.
+//
+// CollectBlobs reads the metadata of every cache entry, so it makes one
+// request per entry.
+func (c *Cache) CollectBlobs(minAge time.Duration) error {
+	if err := c.permit("Delete"); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	var (
+		mu         sync.Mutex
+		referenced = make(map[string]bool)
+		blobs      []ObjectInfo
+		firstErr   error
+		wg         sync.WaitGroup
+	)
+	err := c.store().List(ctx, c.keyPrefix(), func(objects []ObjectInfo) error {
+		for _, o := range objects {
+			if c.isBlobKey(o.Key) {
+				blobs = append(blobs, o)
+				continue
+			}
+			ctx, release, err := c.acquire(ctx)
+			if err != nil {
+				return err
+			}
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				defer release()
+				h, err := c.store().Head(ctx, key)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if sum := h.Get(blobHeader); sum != "" {
+					referenced[c.blobKey(sum)] = true
+				}
+			}(o.Key)
+		}
+		return nil
+	})
+	wg.Wait()
+	if err == nil {
+		err = firstErr
+	}
+	if err != nil {
+		// Without every pointer, referenced blobs could be deleted.
+		return err
+	}
+	var unreferenced []string
+	for _, b := range blobs {
+		if !referenced[b.Key] && c.now().Sub(b.LastModified) > minAge {
+			unreferenced = append(unreferenced, b.Key)
+		}
+	}
+	if len(unreferenced) == 0 {
+		return nil
+	}
+	return c.deleteObjects(ctx, unreferenced)
+}
@@ -0,0 +1,101 @@
+package s3cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// encodingHeader records the Content-Encoding of the body of a cache entry
+// that is a serialized HTTP response. It is not the Content-Encoding of the
+// object, which describes the compression applied by Gzip or Compress.
+const encodingHeader = "X-Amz-Meta-S3cache-Content-Encoding"
+
+// setEncoding records in h the Content-Encoding, if any, of the response
+// whose header is rh.
+func setEncoding(h, rh http.Header) {
+	if ce := rh.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		h.Set(encodingHeader, ce)
+	}
+}
+
+// GetDecoded is like GetWithError, but if the cache entry is a serialized
+// HTTP response whose body was stored with a Content-Encoding (as recorded
+// by Set, or for an entry served by the FallbackCache, as stated by the
+// response), it returns the response with its body decoded, and without
+// the Content-Encoding header. Get returns such entries unchanged.
+//
+// Gzip is decoded, as are the encodings in Decoders, such as "br" and
+// "zstd", for which the standard library has no decoder. GetDecoded fails
+// for entries with other encodings.
+func (c *Cache) GetDecoded(key string) (resp []byte, ok bool, err error) {
+	e, ok, err := c.lookup(context.Background(), key, false)
+	resp = e.resp
+	encoded := e.meta.Get(encodingHeader) != ""
+	if ok && e.meta == nil {
+		ce := responseHeader(resp).Get("Content-Encoding")
+		encoded = ce != "" && ce != "identity"
+	}
+	if ok && encoded {
+		if resp, err = c.decodeResponse(resp); err != nil {
+			return nil, false, c.wrapError("Get", key, err)
+		}
+	}
+	return resp, ok, c.wrapError("Get", key, err)
+}
+
+// decodeResponse returns the serialized HTTP response resp with its body
+// decoded according to its Content-Encoding.
+func (c *Cache) decodeResponse(resp []byte) ([]byte, error) {
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	var body io.Reader = r.Body
+	// Encodings are listed in the order in which they were applied.
+	encodings := strings.Split(r.Header.Get("Content-Encoding"), ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		ce := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if body, err = c.decoder(ce, body); err != nil {
+			return nil, err
+		}
+	}
+	decoded, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("s3cache: decoding response body: %s", err)
+	}
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(decoded)))
+	r.Body = ioutil.NopCloser(bytes.NewReader(decoded))
+	r.ContentLength = int64(len(decoded))
+	r.TransferEncoding = nil
+	r.Uncompressed = true
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decoder returns a reader that decodes body, encoded with the content
+// coding ce.
+func (c *Cache) decoder(ce string, body io.Reader) (io.Reader, error) {
+	if dec := c.Decoders[ce]; dec != nil {
+		return dec(body)
+	}
+	switch ce {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	}
+	return nil, fmt.Errorf("s3cache: no decoder for Content-Encoding %q", ce)
+}
@@ -0,0 +1,46 @@
+package s3cache_test
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func TestGetDecoded(t *testing.T) {
+	body := []byte("hello, world")
+	resp := append([]byte("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n"), gzipped(t, body)...)
+
+	st := memstore.New()
+	fallback := &s3cache.Cache{Store: memstore.New()}
+	fallback.Set("fallen back", resp)
+	c := &s3cache.Cache{Store: st, FallbackCache: fallback}
+	c.Set("k", resp)
+
+	if got, _ := c.Get("k"); !bytes.Equal(got, resp) {
+		t.Errorf("Get = %q, want the entry unchanged", got)
+	}
+	check := func(key string) {
+		got, ok, err := c.GetDecoded(key)
+		if err != nil || !ok {
+			t.Fatalf("GetDecoded(%q) = %v, %v", key, ok, err)
+		}
+		r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(got)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if !bytes.Equal(b, body) || r.Header.Get("Content-Encoding") != "" {
+			t.Errorf("GetDecoded(%q) body = %q with Content-Encoding %q, want %q decoded", key, b, r.Header.Get("Content-Encoding"), body)
+		}
+	}
+	check("k")
+	// The fallback's entry has no metadata, so its encoding is read from
+	// the response.
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 503})
+	check("fallen back")
+}
@@ -0,0 +1,37 @@
+package s3cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrNotFound matches, with errors.Is, the errors returned when an object
+// that an operation requires does not exist in S3, such as a StatusError
+// with status 404. Operations that look up cache entries report a missing
+// entry as a miss instead.
+var ErrNotFound = errors.New("s3cache: object not found")
+
+// wrapError returns err annotated with the operation op and the object key
+// of the cache entry for key, or nil if err is nil or is a backend error and
+// FailMode is FailOpen. The returned error wraps err, so that callers can
+// inspect it with errors.Is and errors.As.
+func (c *Cache) wrapError(op, key string, err error) error {
+	if err == nil || c.FailMode == FailOpen && backendError(err) {
+		return nil
+	}
+	return fmt.Errorf("s3cache: %s %s: %w", op, c.ObjectKey(key), err)
+}
+
+// Is reports whether target is ErrNotFound and e reports a missing object,
+// or target is ErrThrottled and e reports throttling.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		code := e.code()
+		return e.StatusCode == http.StatusNotFound && code != "NoSuchBucket" || code == "NoSuchKey"
+	case ErrThrottled:
+		return e.Category() == CategoryThrottled
+	}
+	return false
+}
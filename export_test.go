@@ -0,0 +1,27 @@
+package s3cache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ReadAll exposes readAll to the benchmarks in package s3cache_test.
+var ReadAll = readAll
+
+// SignV4 signs req with Signature Version 4 as of now, with the credentials
+// and region with which c signs the requests it sends.
+func (c *Cache) SignV4(req *http.Request, now time.Time) error {
+	keys, err := c.keys(context.Background())
+	if err != nil {
+		return err
+	}
+	signV4(req, *keys, c.region(), now)
+	return nil
+}
+
+// NewRequest returns a request with the given method for the object of the
+// cache entry for key, as c would send it before signing it.
+func (c *Cache) NewRequest(method, key string) (*http.Request, error) {
+	return c.newObjectRequest(method, c.ObjectKey(key), "", nil)
+}
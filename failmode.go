@@ -0,0 +1,45 @@
+package s3cache
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// A FailMode determines whether the methods of a Cache that return errors
+// report failures of the backend, such as S3 being unreachable.
+type FailMode int
+
+const (
+	// FailClosed reports backend failures to the caller as errors. It is
+	// the default.
+	FailClosed FailMode = iota
+
+	// FailOpen reports backend failures as if the operation had found
+	// nothing to do: lookups report a miss, and writes and deletes report
+	// success, so that the caller falls back to the origin.
+	FailOpen
+)
+
+// String returns "fail-closed" or "fail-open".
+func (m FailMode) String() string {
+	if m == FailOpen {
+		return "fail-open"
+	}
+	return "fail-closed"
+}
+
+// backendError reports whether err is a failure of the backend, which
+// FailOpen collapses to a miss: an error response from S3, a network
+// error or timeout, an open circuit breaker, or a corrupt or stale entry.
+// Errors caused by the caller or the Cache's configuration, such as
+// ErrTooLarge or ErrSSECustomerKey, are not backend errors.
+func backendError(err error) bool {
+	var (
+		se *StatusError
+		ne net.Error
+	)
+	return errors.As(err, &se) || errors.As(err, &ne) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrStaleRead)
+}
@@ -0,0 +1,45 @@
+package s3cache_test
+
+import (
+	"errors"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func TestFailMode(t *testing.T) {
+	unavailable := &s3cache.StatusError{StatusCode: 500}
+	for _, mode := range []s3cache.FailMode{s3cache.FailClosed, s3cache.FailOpen} {
+		st := memstore.New()
+		c := &s3cache.Cache{Store: st, FailMode: mode, MaxObjectSize: 10}
+		c.Set("k", []byte("v"))
+		wantErr := mode == s3cache.FailClosed
+
+		st.Fail("Get", 1, unavailable)
+		resp, ok, err := c.GetWithError("k")
+		if ok || resp != nil || (err != nil) != wantErr {
+			t.Errorf("%s: Get = %q, %v, %v; want a miss", mode, resp, ok, err)
+		}
+		if wantErr && !errors.Is(err, unavailable) {
+			t.Errorf("%s: Get returned %v, which does not wrap the backend error", mode, err)
+		}
+
+		st.Fail("Put", 1, unavailable)
+		if err := c.SetWithError("k", []byte("w")); (err != nil) != wantErr {
+			t.Errorf("%s: Set = %v", mode, err)
+		}
+		st.Fail("Delete", 1, unavailable)
+		if err := c.DeleteWithError("k"); (err != nil) != wantErr {
+			t.Errorf("%s: Delete = %v", mode, err)
+		}
+		if resp, ok, err := c.GetWithError("k"); !ok || string(resp) != "v" || err != nil {
+			t.Errorf("%s: the failed Set or Delete took effect: Get = %q, %v, %v", mode, resp, ok, err)
+		}
+
+		// Errors that are not failures of the backend are always reported.
+		if err := c.SetWithError("k", []byte("too large for the cache")); !errors.Is(err, s3cache.ErrTooLarge) {
+			t.Errorf("%s: Set of a large entry = %v, want ErrTooLarge", mode, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package s3cache
+
+import (
+	"errors"
+	"sync"
+)
+
+// States of a Cache's circuit breaker, as returned by CircuitState.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// lastError is the error with which the Cache's most recent operation
+// failed.
+type lastError struct {
+	mu  sync.Mutex
+	err error
+}
+
+// setLastError records the outcome of an operation on S3. Errors that are
+// ordinary answers to the request, for a negatively cached key, an
+// unmodified entry (304 Not Modified) or an unsatisfiable range, are not
+// failures.
+func (c *Cache) setLastError(err error) {
+	if errors.Is(err, ErrNegativeCached) || errors.Is(err, ErrInvalidRange) || notModified(err) {
+		err = nil
+	}
+	c.lastErr.mu.Lock()
+	c.lastErr.err = err
+	c.lastErr.mu.Unlock()
+}
+
+// LastError returns the error with which the most recent operation on S3
+// failed, or nil if it succeeded (including by reporting a cache miss).
+// Operations that are skipped, such as while the circuit breaker is open,
+// do not change it. It is intended for reporting the health of the Cache.
+func (c *Cache) LastError() error {
+	c.lastErr.mu.Lock()
+	defer c.lastErr.mu.Unlock()
+	return c.lastErr.err
+}
+
+// CircuitState returns the state of the Cache's circuit breaker (see
+// BreakerThreshold): CircuitClosed if operations are attempted normally,
+// CircuitOpen if they are being skipped, or CircuitHalfOpen if the cooldown
+// has passed and an operation may be attempted, or is being attempted, to
+// probe whether S3 has recovered. It is always CircuitClosed if
+// BreakerThreshold is not positive.
+func (c *Cache) CircuitState() string {
+	if c.BreakerThreshold <= 0 {
+		return CircuitClosed
+	}
+	b := &c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return CircuitClosed
+	case b.probing || !c.now().Before(b.openUntil):
+		return CircuitHalfOpen
+	default:
+		return CircuitOpen
+	}
+}
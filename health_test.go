@@ -0,0 +1,48 @@
+package s3cache_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func TestLastError(t *testing.T) {
+	st := memstore.New()
+	c := &s3cache.Cache{Store: st}
+	if err := c.SetWithError("k", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 500})
+	if _, _, err := c.GetWithError("k"); err == nil {
+		t.Fatal("got no error from a failing Get")
+	}
+	if c.LastError() == nil {
+		t.Error("LastError is nil after a failed Get")
+	}
+	if _, ok := c.Get("k"); !ok || c.LastError() != nil {
+		t.Errorf("after a successful Get, LastError = %v, want nil", c.LastError())
+	}
+
+	// Ordinary answers to requests are not failures.
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 500})
+	c.Get("k")
+	_, modified, ok, err := c.GetIfModifiedSince("k", time.Now().Add(time.Hour))
+	if modified || !ok || err != nil {
+		t.Fatalf("GetIfModifiedSince = %v, %v, %v; want unmodified", modified, ok, err)
+	}
+	if err := c.LastError(); err != nil {
+		t.Errorf("after 304 Not Modified, LastError = %v, want nil", err)
+	}
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 500})
+	c.Get("k")
+	if _, _, err := c.GetRange("k", 100, 200); !errors.Is(err, s3cache.ErrInvalidRange) {
+		t.Fatalf("GetRange beyond the entry: got %v, want ErrInvalidRange", err)
+	}
+	if err := c.LastError(); err != nil {
+		t.Errorf("after an unsatisfiable range, LastError = %v, want nil", err)
+	}
+}
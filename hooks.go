@@ -0,0 +1,66 @@
+package s3cache
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+func (c *Cache) onHit(key string) {
+	if c.OnHit != nil {
+		c.OnHit(key)
+	}
+	if c.Logger != nil {
+		c.Logger.Debug("s3cache hit", "op", "Get", "key", key)
+	}
+}
+
+func (c *Cache) onMiss(key string) {
+	if c.OnMiss != nil {
+		c.OnMiss(key)
+	}
+	if c.Logger != nil {
+		c.Logger.Debug("s3cache miss", "op", "Get", "key", key)
+	}
+}
+
+func (c *Cache) onError(op, key string, err error) {
+	if c.OnError != nil {
+		c.OnError(op, key, err)
+	}
+	if c.Logger != nil {
+		c.Logger.Error("s3cache operation failed", logAttrs(op, key, err)...)
+	}
+}
+
+func (c *Cache) onSkip(op, key string, reason error) {
+	if c.OnSkip != nil {
+		c.OnSkip(op, key, reason)
+	}
+	if c.Logger != nil {
+		c.Logger.Warn("s3cache operation skipped", logAttrs(op, key, reason)...)
+	}
+}
+
+func (c *Cache) logRetry(op, key string, err error, attempt int, delay time.Duration) {
+	if c.Logger != nil {
+		attrs := append(logAttrs(op, key, err), slog.Int("attempt", attempt), slog.Duration("delay", delay))
+		c.Logger.Warn("s3cache retrying operation", attrs...)
+	}
+}
+
+// logAttrs returns the log attributes describing an operation that failed
+// with err.
+func logAttrs(op, key string, err error) []any {
+	attrs := []any{slog.String("op", op), slog.String("key", key)}
+	if e, ok := err.(*StatusError); ok {
+		attrs = append(attrs, slog.Int("status", e.StatusCode))
+	}
+	return append(attrs, slog.Any("err", err))
+}
+
+// skipped reports whether err indicates that an operation was deliberately
+// skipped, rather than that it failed.
+func skipped(err error) bool {
+	return errors.Is(err, ErrTooLarge) || errors.Is(err, ErrNotCacheable) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrReadOnly) || errors.Is(err, ErrWriteOnly)
+}
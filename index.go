@@ -0,0 +1,220 @@
+package s3cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexDir is the directory, under Prefix, that holds the index objects
+// written when Index is set.
+const indexDir = "index/"
+
+const (
+	// defaultIndexBatchSize is the default value of IndexBatchSize.
+	defaultIndexBatchSize = 1000
+
+	// defaultIndexFlushInterval is the default value of
+	// IndexFlushInterval.
+	defaultIndexFlushInterval = time.Minute
+)
+
+// An indexLog holds the index entries that have yet to be written to an
+// index object.
+type indexLog struct {
+	mu      sync.Mutex
+	pending map[string]string // object key -> cache key
+	timer   *time.Timer       // flushes pending, if it is not empty
+	closed  bool              // no timer is started once the Cache is closed
+}
+
+// isIndexKey reports whether objectKey is the key of an index object.
+func (c *Cache) isIndexKey(objectKey string) bool {
+	return strings.HasPrefix(objectKey, c.keyPrefix()+indexDir)
+}
+
+// addToIndex records the object key of the cache entry for key in the
+// index, if Index is set, flushing the index if the batch is full.
+func (c *Cache) addToIndex(key string) {
+	if !c.Index {
+		return
+	}
+	l := &c.index
+	l.mu.Lock()
+	if l.pending == nil {
+		l.pending = make(map[string]string)
+	}
+	l.pending[c.ObjectKey(key)] = key
+	batchSize := c.IndexBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultIndexBatchSize
+	}
+	full := len(l.pending) >= batchSize
+	if !full && l.timer == nil && !l.closed {
+		l.timer = c.startIndexTimer()
+	}
+	l.mu.Unlock()
+	if full {
+		c.flushIndex(context.Background())
+	}
+}
+
+// startIndexTimer returns a timer that flushes the index after
+// IndexFlushInterval.
+func (c *Cache) startIndexTimer() *time.Timer {
+	interval := c.IndexFlushInterval
+	if interval <= 0 {
+		interval = defaultIndexFlushInterval
+	}
+	return time.AfterFunc(interval, func() {
+		c.flushIndex(context.Background())
+	})
+}
+
+// FlushIndex writes the index entries recorded since the last flush to a
+// new index object. Close calls FlushIndex, so that pending entries are not
+// lost on shutdown.
+func (c *Cache) FlushIndex() error {
+	return c.flushIndex(context.Background())
+}
+
+// closeIndex flushes the pending index entries for the last time: once the
+// Cache is closed, failed flushes are not retried and entries are only
+// flushed by FlushIndex or when a batch is full.
+func (c *Cache) closeIndex() error {
+	l := &c.index
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	return c.FlushIndex()
+}
+
+// flushIndex writes the pending index entries to a new index object,
+// reporting any error to OnError. Entries that could not be written are
+// kept pending and retried on the next flush, which is scheduled after
+// IndexFlushInterval.
+func (c *Cache) flushIndex(ctx context.Context) error {
+	l := &c.index
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	objectKeys := make([]string, 0, len(pending))
+	for objectKey := range pending {
+		objectKeys = append(objectKeys, objectKey)
+	}
+	sort.Strings(objectKeys)
+	var buf bytes.Buffer
+	for _, objectKey := range objectKeys {
+		fmt.Fprintf(&buf, "%s %s\n", strconv.Quote(objectKey), strconv.Quote(pending[objectKey]))
+	}
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	// Index objects are named by the time they were written, so that they
+	// are listed in order.
+	indexKey := c.keyPrefix() + indexDir + c.now().UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix[:])
+	h := c.uploadHeader()
+	h.Del("Content-Encoding")
+	h.Del("If-None-Match")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	err := c.retry(ctx, "Set", indexKey, func() error {
+		return c.store().Put(ctx, indexKey, bytes.NewReader(buf.Bytes()), int64(buf.Len()), h)
+	})
+	if err != nil {
+		c.onError("Set", indexKey, err)
+		l.mu.Lock()
+		if l.pending == nil {
+			l.pending = make(map[string]string, len(pending))
+		}
+		for objectKey, key := range pending {
+			if _, ok := l.pending[objectKey]; !ok {
+				l.pending[objectKey] = key
+			}
+		}
+		// Retry after the flush interval, even if no entries are added.
+		if l.timer == nil && !l.closed {
+			l.timer = c.startIndexTimer()
+		}
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// LookupOriginalKey returns the cache key whose entry is stored in the
+// object with the given key, as recorded in the index written when Index is
+// set. It reads every index object, newest first, so it is meant for audits
+// and targeted invalidation rather than for frequent use. If the object key
+// is not in the index, LookupOriginalKey returns ErrNotFound.
+func (c *Cache) LookupOriginalKey(objectKey string) (string, error) {
+	c.index.mu.Lock()
+	key, ok := c.index.pending[objectKey]
+	c.index.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	ctx := context.Background()
+	var indexKeys []string
+	err := c.store().List(ctx, c.keyPrefix()+indexDir, func(objects []ObjectInfo) error {
+		for _, o := range objects {
+			indexKeys = append(indexKeys, o.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(indexKeys)
+	for i := len(indexKeys) - 1; i >= 0; i-- {
+		key, ok, err := c.lookupIndex(ctx, indexKeys[i], objectKey)
+		if err != nil || ok {
+			return key, err
+		}
+	}
+	return "", ErrNotFound
+}
+
+// lookupIndex returns the cache key recorded for objectKey in the index
+// object with the given key.
+func (c *Cache) lookupIndex(ctx context.Context, indexKey, objectKey string) (key string, ok bool, err error) {
+	body, _, err := c.store().Get(ctx, indexKey, nil)
+	if err != nil || body == nil {
+		return "", false, err
+	}
+	defer body.Close()
+	want := strconv.Quote(objectKey) + " "
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, want) {
+			key, err := strconv.Unquote(strings.TrimSpace(line[len(want):]))
+			if err != nil {
+				return "", false, fmt.Errorf("s3cache: malformed index object %s: %v", indexKey, err)
+			}
+			return key, true, nil
+		}
+		if err == io.EOF {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package s3cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// indexObjects returns the number of index objects in st.
+func indexObjects(t *testing.T, st *memstore.Store) int {
+	var n int
+	err := st.List(context.Background(), "index/", func(objects []s3cache.ObjectInfo) error {
+		n += len(objects)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIndex(t *testing.T) {
+	st := memstore.New()
+	c := &s3cache.Cache{Store: st, Index: true, IndexBatchSize: 2}
+	c.Set("a", []byte("v"))
+	if n := indexObjects(t, st); n != 0 {
+		t.Fatalf("%d index objects written before the batch was full", n)
+	}
+	c.Set("b", []byte("v"))
+	if n := indexObjects(t, st); n != 1 {
+		t.Fatalf("%d index objects written for a full batch, want 1", n)
+	}
+	c.Set("c", []byte("v"))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if got, err := c.LookupOriginalKey(c.ObjectKey(key)); err != nil || got != key {
+			t.Errorf("LookupOriginalKey for %s = %q, %v", key, got, err)
+		}
+	}
+}
+
+// TestIndexFlushRetry checks that entries whose flush failed are flushed
+// again after IndexFlushInterval, even if no entries are added.
+func TestIndexFlushRetry(t *testing.T) {
+	st := memstore.New()
+	c := &s3cache.Cache{Store: st, Index: true, IndexFlushInterval: 100 * time.Millisecond, OnError: func(string, string, error) {}}
+	c.Set("k", []byte("v"))
+	st.Fail("Put", 1, &s3cache.StatusError{StatusCode: 400})
+	if err := c.FlushIndex(); err == nil {
+		t.Fatal("FlushIndex succeeded despite the injected failure")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for indexObjects(t, st) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the index was not flushed again after a failed flush")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestIndexFlushAfterClose checks that a flush that failed on Close is not
+// retried after IndexFlushInterval.
+func TestIndexFlushAfterClose(t *testing.T) {
+	st := memstore.New()
+	c := &s3cache.Cache{Store: st, Index: true, IndexFlushInterval: 10 * time.Millisecond, OnError: func(string, string, error) {}}
+	c.Set("k", []byte("v"))
+	st.Fail("Put", 1, &s3cache.StatusError{StatusCode: 400})
+	if err := c.Close(); err == nil {
+		t.Fatal("Close succeeded despite the injected failure")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := indexObjects(t, st); n != 0 {
+		t.Errorf("%d index objects written after Close", n)
+	}
+}
@@ -0,0 +1,42 @@
+package s3cache
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrTooLarge is returned when a cache entry is not stored because it is
+// larger than the Cache's MaxObjectSize.
+var ErrTooLarge = errors.New("s3cache: cache entry exceeds MaxObjectSize")
+
+// ErrNotCacheable is returned when a cache entry is not stored because the
+// Cache's ShouldCache predicate rejected it.
+var ErrNotCacheable = errors.New("s3cache: cache entry rejected by ShouldCache")
+
+// tooLarge reports whether an entry of the given size exceeds the Cache's
+// MaxObjectSize.
+func (c *Cache) tooLarge(size int64) bool {
+	return c.MaxObjectSize > 0 && size > c.MaxObjectSize
+}
+
+// maxSizeReader is an io.Reader that fails with ErrTooLarge once more than
+// n bytes have been read from r.
+type maxSizeReader struct {
+	r io.Reader
+	n int64 // bytes remaining before the limit is exceeded
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.n < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return 0, ErrTooLarge
+	}
+	return n, err
+}
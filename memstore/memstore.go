@@ -0,0 +1,225 @@
+// Package memstore provides an in-memory implementation of s3cache.Store,
+// for testing code that uses s3cache without access to S3.
+package memstore // import "sourcegraph.com/sourcegraph/s3cache/memstore"
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+)
+
+// pageSize is the number of objects listed per page, as in S3.
+const pageSize = 1000
+
+// A Store is an in-memory s3cache.Store. Faults can be injected with Fail to
+// exercise error handling.
+//
+// A Store is safe for concurrent use by multiple goroutines.
+type Store struct {
+	mu      sync.Mutex
+	objects map[string]*object
+	faults  map[string][]error
+}
+
+type object struct {
+	data    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+// New returns an empty Store.
+func New() *Store {
+	return &Store{
+		objects: make(map[string]*object),
+		faults:  make(map[string][]error),
+	}
+}
+
+// Fail makes the next n calls of the Store method op ("Get", "Head", "Put",
+// "Delete" or "List") fail with err, without otherwise taking effect. To
+// simulate an S3 error response, use an *s3cache.StatusError, e.g.
+//
+//	s.Fail("Get", 3, &s3cache.StatusError{StatusCode: 503})
+func (s *Store) Fail(op string, n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults[op] = append(s.faults[op], err)
+	}
+}
+
+// fault returns the next injected error for op, if any. The caller must
+// hold s.mu.
+func (s *Store) fault(op string) error {
+	errs := s.faults[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	s.faults[op] = errs[1:]
+	return errs[0]
+}
+
+// Len returns the number of objects in the Store.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+func (s *Store) Get(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("Get"); err != nil {
+		return nil, nil, err
+	}
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, nil, nil
+	}
+	if v := h.Get("If-Modified-Since"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && !o.modTime.Truncate(time.Second).After(t) {
+			return nil, nil, &s3cache.StatusError{StatusCode: http.StatusNotModified}
+		}
+	}
+	data := o.data
+	if r := h.Get("Range"); r != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil || start > end {
+			return nil, nil, &s3cache.StatusError{StatusCode: http.StatusBadRequest, Body: "InvalidArgument"}
+		}
+		if start >= int64(len(data)) {
+			return nil, nil, &s3cache.StatusError{StatusCode: http.StatusRequestedRangeNotSatisfiable, Body: "InvalidRange"}
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		data = data[start : end+1]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), o.responseHeader(), nil
+}
+
+func (s *Store) Head(ctx context.Context, key string) (http.Header, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("Head"); err != nil {
+		return nil, err
+	}
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, nil
+	}
+	return o.responseHeader(), nil
+}
+
+func (s *Store) Put(ctx context.Context, key string, body io.Reader, size int64, h http.Header) error {
+	s.mu.Lock()
+	err := s.fault("Put")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if size >= 0 {
+		// Read exactly size bytes, without growing a buffer.
+		data = make([]byte, size)
+		if _, err := io.ReadFull(body, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	} else if data, err = ioutil.ReadAll(body); err != nil {
+		return err
+	}
+	if want := h.Get("Content-Md5"); want != "" {
+		sum := md5.Sum(data)
+		if base64.StdEncoding.EncodeToString(sum[:]) != want {
+			return &s3cache.StatusError{StatusCode: http.StatusBadRequest, Body: "BadDigest"}
+		}
+	}
+	header := make(http.Header, len(h))
+	for k, v := range h {
+		header[k] = append([]string(nil), v...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.objects[key]; exists && h.Get("If-None-Match") == "*" {
+		return &s3cache.StatusError{StatusCode: http.StatusPreconditionFailed, Body: "PreconditionFailed"}
+	}
+	s.objects[key] = &object{data: data, header: header, modTime: time.Now()}
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("Delete"); err != nil {
+		return err
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *Store) List(ctx context.Context, prefix string, fn func([]s3cache.ObjectInfo) error) error {
+	s.mu.Lock()
+	if err := s.fault("List"); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	var infos []s3cache.ObjectInfo
+	for key, o := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, s3cache.ObjectInfo{
+				Key:          key,
+				Size:         int64(len(o.data)),
+				LastModified: o.modTime,
+				ETag:         o.etag(),
+			})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	for len(infos) > 0 {
+		n := len(infos)
+		if n > pageSize {
+			n = pageSize
+		}
+		if err := fn(infos[:n]); err != nil {
+			return err
+		}
+		infos = infos[n:]
+	}
+	return nil
+}
+
+// responseHeader returns the header with which S3 would respond to a
+// request for o.
+func (o *object) responseHeader() http.Header {
+	h := make(http.Header, len(o.header)+3)
+	for k, v := range o.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(o.data)))
+	h.Set("Last-Modified", o.modTime.UTC().Format(http.TimeFormat))
+	h.Set("Etag", o.etag())
+	return h
+}
+
+func (o *object) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -0,0 +1,160 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+var ctx = context.Background()
+
+func put(t *testing.T, s *memstore.Store, key, data string) {
+	t.Helper()
+	if err := s.Put(ctx, key, strings.NewReader(data), int64(len(data)), http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, s *memstore.Store, key string) (string, error) {
+	t.Helper()
+	body, _, err := s.Get(ctx, key, nil)
+	if err != nil || body == nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	return string(data), err
+}
+
+func TestMissing(t *testing.T) {
+	s := memstore.New()
+	if body, h, err := s.Get(ctx, "k", nil); body != nil || h != nil || err != nil {
+		t.Errorf("Get = %v, %v, %v; want nil, nil, nil", body, h, err)
+	}
+	if h, err := s.Head(ctx, "k"); h != nil || err != nil {
+		t.Errorf("Head = %v, %v; want nil, nil", h, err)
+	}
+	if err := s.Delete(ctx, "k"); err != nil {
+		t.Errorf("Delete = %v", err)
+	}
+}
+
+func TestFailN(t *testing.T) {
+	s := memstore.New()
+	put(t, s, "k", "v")
+	unavailable := &s3cache.StatusError{StatusCode: 503}
+	s.Fail("Get", 3, unavailable)
+	for i := 0; i < 3; i++ {
+		if _, err := get(t, s, "k"); err != unavailable {
+			t.Fatalf("Get %d = %v, want the injected error", i, err)
+		}
+	}
+	if data, err := get(t, s, "k"); err != nil || data != "v" {
+		t.Errorf("after the injected errors, Get = %q, %v", data, err)
+	}
+	// Faults are injected per method.
+	if h, err := s.Head(ctx, "k"); err != nil || h == nil {
+		t.Errorf("Head = %v, %v", h, err)
+	}
+}
+
+func TestFailPutOnce(t *testing.T) {
+	s := memstore.New()
+	injected := errors.New("injected")
+	s.Fail("Put", 1, injected)
+	if err := s.Put(ctx, "k", strings.NewReader("v"), 1, http.Header{}); err != injected {
+		t.Fatalf("Put = %v, want the injected error", err)
+	}
+	if s.Len() != 0 {
+		t.Fatal("the failed Put stored the object")
+	}
+	put(t, s, "k", "v")
+	put(t, s, "k", "w")
+	if data, err := get(t, s, "k"); err != nil || data != "w" {
+		t.Errorf("Get = %q, %v", data, err)
+	}
+}
+
+// TestFailRetries checks that a Cache retrying injected errors makes a
+// deterministic number of attempts.
+func TestFailRetries(t *testing.T) {
+	s := memstore.New()
+	c := &s3cache.Cache{Store: s, MaxRetries: 3, RetryBaseDelay: time.Nanosecond}
+	c.Set("k", []byte("v"))
+	s.Fail("Get", 3, &s3cache.StatusError{StatusCode: 503})
+	if resp, ok, err := c.GetWithError("k"); err != nil || !ok || string(resp) != "v" {
+		t.Errorf("Get = %q, %v, %v; want the entry after 3 retries", resp, ok, err)
+	}
+	s.Fail("Get", 4, &s3cache.StatusError{StatusCode: 503})
+	if _, _, err := c.GetWithError("k"); err == nil {
+		t.Error("Get succeeded despite more failures than retries")
+	}
+}
+
+func TestPutOptions(t *testing.T) {
+	s := memstore.New()
+	h := http.Header{"If-None-Match": {"*"}}
+	if err := s.Put(ctx, "k", strings.NewReader("v"), 1, h); err != nil {
+		t.Fatal(err)
+	}
+	var se *s3cache.StatusError
+	if err := s.Put(ctx, "k", strings.NewReader("w"), 1, h); !errors.As(err, &se) || se.StatusCode != 412 {
+		t.Errorf("conditional Put over an existing object = %v, want 412", err)
+	}
+	bad := http.Header{"Content-Md5": {"1B2M2Y8AsgTpgAmY7PhCfg=="}} // of ""
+	if err := s.Put(ctx, "m", strings.NewReader("v"), 1, bad); !errors.As(err, &se) || se.StatusCode != 400 {
+		t.Errorf("Put with a wrong Content-MD5 = %v, want 400", err)
+	}
+	if err := s.Put(ctx, "short", strings.NewReader("v"), 2, http.Header{}); err == nil {
+		t.Error("Put of fewer than size bytes succeeded")
+	}
+
+	put(t, s, "r", "0123456789")
+	body, _, err := s.Get(ctx, "r", http.Header{"Range": {"bytes=2-4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(body); string(data) != "234" {
+		t.Errorf("range read %q, want 234", data)
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if _, _, err := s.Get(ctx, "r", http.Header{"If-Modified-Since": {future}}); !errors.As(err, &se) || se.StatusCode != 304 {
+		t.Errorf("conditional Get of an unmodified object = %v, want 304", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := memstore.New()
+	for i := 0; i < 2500; i++ {
+		put(t, s, "a/"+strconv.Itoa(i), "v")
+	}
+	put(t, s, "b/0", "v")
+	var pages, n int
+	var last string
+	err := s.List(ctx, "a/", func(objects []s3cache.ObjectInfo) error {
+		pages++
+		for _, o := range objects {
+			if o.Key <= last || !strings.HasPrefix(o.Key, "a/") || o.Size != 1 {
+				t.Fatalf("listed %+v after %q", o, last)
+			}
+			last = o.Key
+			n++
+		}
+		return nil
+	})
+	if err != nil || pages != 3 || n != 2500 {
+		t.Errorf("List = %v, with %d objects in %d pages; want 2500 in 3", err, n, pages)
+	}
+	stop := errors.New("stop")
+	if err := s.List(ctx, "", func([]s3cache.ObjectInfo) error { return stop }); err != stop {
+		t.Errorf("List = %v, want the callback's error", err)
+	}
+}
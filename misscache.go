@@ -0,0 +1,76 @@
+package s3cache
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultNegativeCacheSize is the number of recent misses remembered when
+// NegativeCacheTTL is set and NegativeCacheSize is not.
+const defaultNegativeCacheSize = 10000
+
+// missCache remembers the object keys for which Get recently found no
+// cache entry, as set by NegativeCacheTTL.
+type missCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time // by object key
+}
+
+// recentMiss reports whether Get found no object with the given key within
+// the last NegativeCacheTTL.
+func (c *Cache) recentMiss(objectKey string) bool {
+	if c.NegativeCacheTTL <= 0 {
+		return false
+	}
+	m := &c.misses
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expires, ok := m.expires[objectKey]
+	if ok && !c.now().Before(expires) {
+		delete(m.expires, objectKey)
+		return false
+	}
+	return ok
+}
+
+// recordMiss records that Get found no object with the given key.
+func (c *Cache) recordMiss(objectKey string) {
+	if c.NegativeCacheTTL <= 0 {
+		return
+	}
+	size := c.NegativeCacheSize
+	if size <= 0 {
+		size = defaultNegativeCacheSize
+	}
+	now := c.now()
+	m := &c.misses
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.expires == nil {
+		m.expires = make(map[string]time.Time)
+	}
+	if _, ok := m.expires[objectKey]; !ok && len(m.expires) >= size {
+		for k, expires := range m.expires {
+			if !now.Before(expires) {
+				delete(m.expires, k)
+			}
+		}
+		// If none have expired, forget an arbitrary one.
+		for k := range m.expires {
+			if len(m.expires) < size {
+				break
+			}
+			delete(m.expires, k)
+		}
+	}
+	m.expires[objectKey] = now.Add(c.NegativeCacheTTL)
+}
+
+// forgetMiss forgets a recorded miss of the object with the given key,
+// which has been written.
+func (c *Cache) forgetMiss(objectKey string) {
+	m := &c.misses
+	m.mu.Lock()
+	delete(m.expires, objectKey)
+	m.mu.Unlock()
+}
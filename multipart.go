@@ -0,0 +1,319 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// minPartSize is the minimum size of all but the last part of a
+	// multipart upload.
+	minPartSize = 5 << 20
+
+	// maxParts is the maximum number of parts in a multipart upload.
+	maxParts = 10000
+
+	defaultUploadConcurrency = 4
+)
+
+// multipart reports whether an object of the given size, which is negative
+// if it is not known in advance, is uploaded in parts.
+func (c *Cache) multipart(size int64) bool {
+	return size < 0 || (c.MultipartThreshold > 0 && size > c.MultipartThreshold)
+}
+
+func (c *Cache) partSize() int64 {
+	if c.PartSize < minPartSize {
+		return minPartSize
+	}
+	return c.PartSize
+}
+
+func (c *Cache) uploadConcurrency() int {
+	if c.UploadConcurrency <= 0 {
+		return defaultUploadConcurrency
+	}
+	return c.UploadConcurrency
+}
+
+// uploadedInParts is the context key of a *bool that putMultipart sets, so
+// that retry can tell that the upload was made in parts. Since each request
+// of a multipart upload is retried on its own, the upload is not retried
+// as a whole.
+type uploadedInParts struct{}
+
+type initiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber     int
+	ETag           string
+	ChecksumCRC32C string `xml:",omitempty"`
+	ChecksumSHA256 string `xml:",omitempty"`
+}
+
+// putMultipart stores the object read from body using a multipart upload,
+// uploading up to c.UploadConcurrency parts at a time, within the Cache's
+// MaxConcurrency. Each request is retried up to c.MaxRetries times. If the
+// upload fails, it is aborted, so that S3 does not keep the parts already
+// uploaded.
+func (s s3Store) putMultipart(ctx context.Context, key string, body io.Reader, h http.Header) (err error) {
+	if p, ok := ctx.Value(uploadedInParts{}).(*bool); ok {
+		*p = true
+	}
+	// Content-MD5 and checksums apply to each part, and If-None-Match to
+	// completing the upload, rather than to initiating it.
+	verify := h.Get("Content-Md5") != "" || objectLockedHeader(h)
+	ifNoneMatch := h.Get("If-None-Match")
+	h = cloneHeader(h)
+	h.Del("Content-Md5")
+	h.Del("If-None-Match")
+	if alg := s.c.ChecksumAlgorithm; alg != "" {
+		h.Del("X-Amz-Sdk-Checksum-Algorithm")
+		h.Del("X-Amz-Checksum-" + alg)
+		h.Set("X-Amz-Checksum-Algorithm", alg)
+	}
+
+	var uploadID string
+	err = s.retryRequest(ctx, "CreateMultipartUpload", key, func() (err error) {
+		uploadID, err = s.createMultipartUpload(ctx, key, h)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.abortMultipartUpload(context.WithoutCancel(ctx), key, uploadID)
+		}
+	}()
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex // guards parts and firstErr
+		parts    []completedPart
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+	sem := make(chan struct{}, s.c.uploadConcurrency())
+	partSize := s.c.partSize()
+	for n := 1; partCtx.Err() == nil; n++ {
+		if n > maxParts {
+			fail(errors.New("s3cache: cache entry has too many parts for a multipart upload; increase PartSize"))
+			break
+		}
+		sem <- struct{}{}
+		ctx, release, err := s.c.acquire(partCtx)
+		if err != nil {
+			<-sem
+			fail(err)
+			break
+		}
+		buf := make([]byte, partSize)
+		m, rerr := io.ReadFull(body, buf)
+		if rerr == io.EOF && n > 1 {
+			release()
+			<-sem
+			break
+		}
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			release()
+			<-sem
+			fail(rerr)
+			break
+		}
+		wg.Add(1)
+		go func(n int, part []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer release()
+			etag, err := s.uploadPart(ctx, key, uploadID, n, part, verify)
+			if err != nil {
+				fail(err)
+				return
+			}
+			cp := completedPart{PartNumber: n, ETag: etag}
+			switch s.c.ChecksumAlgorithm {
+			case ChecksumCRC32C:
+				_, cp.ChecksumCRC32C, _ = s3Checksum(ChecksumCRC32C, part)
+			case ChecksumSHA256:
+				_, cp.ChecksumSHA256, _ = s3Checksum(ChecksumSHA256, part)
+			}
+			mu.Lock()
+			parts = append(parts, cp)
+			mu.Unlock()
+		}(n, buf[:m])
+		if rerr != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return s.retryRequest(ctx, "CompleteMultipartUpload", key, func() error {
+		return s.completeMultipartUpload(ctx, key, uploadID, parts, ifNoneMatch)
+	})
+}
+
+// retryRequest calls fn, which makes the request op of a multipart upload
+// of the object with the given key, retrying it up to c.MaxRetries times.
+func (s s3Store) retryRequest(ctx context.Context, op, key string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= s.c.MaxRetries || ctx.Err() != nil || !retryable(err) || !s.c.spendRetry() {
+			return err
+		}
+		delay := s.c.retryDelay(attempt, err)
+		s.c.logRetry(op, key, err, attempt+1, delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+func (s s3Store) createMultipartUpload(ctx context.Context, key string, h http.Header) (string, error) {
+	req, err := s.c.newObjectRequest("POST", key, "uploads", nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	s.c.setSSECustomer(req.Header, "X-Amz-")
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	defer resp.Body.Close()
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", errors.New("s3cache: S3 returned no upload ID for multipart upload")
+	}
+	return result.UploadId, nil
+}
+
+// uploadPart uploads a part of a multipart upload, retrying it up to
+// c.MaxRetries times, and returns its ETag.
+func (s s3Store) uploadPart(ctx context.Context, key, uploadID string, n int, part []byte, verify bool) (etag string, err error) {
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	err = s.retryRequest(ctx, "UploadPart", key, func() (err error) {
+		etag, err = s.uploadPartOnce(ctx, key, q.Encode(), part, verify)
+		return err
+	})
+	return etag, err
+}
+
+func (s s3Store) uploadPartOnce(ctx context.Context, key, rawQuery string, part []byte, verify bool) (string, error) {
+	req, err := s.c.newObjectRequest("PUT", key, rawQuery, bytes.NewReader(part))
+	if err != nil {
+		return "", err
+	}
+	if verify {
+		sum := md5.Sum(part)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	if err := s.c.setS3Checksum(req.Header, part); err != nil {
+		return "", err
+	}
+	s.c.setSSECustomer(req.Header, "X-Amz-")
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Etag"), nil
+}
+
+func (s s3Store) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart, ifNoneMatch string) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	req, err := s.c.newObjectRequest("POST", key, url.Values{"uploadId": {uploadID}}.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	result, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(result)}
+	}
+	// S3 may report that completing the upload failed in the body of a 200
+	// response.
+	if bytes.Contains(result, []byte("<Error>")) {
+		return &StatusError{StatusCode: http.StatusInternalServerError, Body: string(result)}
+	}
+	return nil
+}
+
+func (s s3Store) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	req, err := s.c.newObjectRequest("DELETE", key, url.Values{"uploadId": {uploadID}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
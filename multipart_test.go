@@ -0,0 +1,100 @@
+package s3cache_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sqs/s3"
+	"github.com/sqs/s3/s3util"
+	"sourcegraph.com/sourcegraph/s3cache"
+)
+
+// fakeMultipartS3 is an S3 server that accepts multipart uploads, failing
+// the first failParts part uploads with 503.
+type fakeMultipartS3 struct {
+	mu        sync.Mutex
+	failParts int
+	requests  map[string]int // by operation
+}
+
+func (f *fakeMultipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.Method == "POST" && q.Has("uploads"):
+		f.requests["CreateMultipartUpload"]++
+		w.Write([]byte("<InitiateMultipartUploadResult><UploadId>u</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == "PUT" && q.Has("partNumber"):
+		f.requests["UploadPart"]++
+		if f.failParts > 0 {
+			f.failParts--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Etag", `"etag"`)
+	case r.Method == "POST" && q.Has("uploadId"):
+		f.requests["CompleteMultipartUpload"]++
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case r.Method == "DELETE" && q.Has("uploadId"):
+		f.requests["AbortMultipartUpload"]++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// TestMultipartRetry checks that each part of a multipart upload is
+// retried up to MaxRetries times, and that the upload as a whole is not
+// retried as well.
+func TestMultipartRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		failParts int
+		want      map[string]int
+		wantErr   bool
+	}{
+		{
+			name:      "part retried",
+			failParts: 2,
+			want:      map[string]int{"CreateMultipartUpload": 1, "UploadPart": 3, "CompleteMultipartUpload": 1},
+		},
+		{
+			name:      "part failed",
+			failParts: 100,
+			want:      map[string]int{"CreateMultipartUpload": 1, "UploadPart": 3, "AbortMultipartUpload": 1},
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := &fakeMultipartS3{failParts: test.failParts, requests: make(map[string]int)}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			c := &s3cache.Cache{
+				Config:             s3util.Config{Keys: &s3.Keys{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}},
+				BucketURL:          srv.URL + "/bucket",
+				MultipartThreshold: 1,
+				MaxRetries:         2,
+				RetryBaseDelay:     time.Millisecond,
+				OnError:            func(string, string, error) {},
+			}
+			err := c.SetWithOptions("k", []byte("a multipart entry"), s3cache.SetOptions{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.requests) != len(test.want) {
+				t.Errorf("got requests %v, want %v", f.requests, test.want)
+			}
+			for op, n := range test.want {
+				if f.requests[op] != n {
+					t.Errorf("got %d %s requests, want %d", f.requests[op], op, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrNegativeCached is returned, wrapped, by GetWithError and GetReader when
+// the cache holds a negative entry for the key, recorded by SetMiss,
+// indicating that the resource is known not to exist.
+var ErrNegativeCached = errors.New("s3cache: key is negatively cached")
+
+const (
+	// negativeHeader marks the objects of negative cache entries.
+	negativeHeader = "X-Amz-Meta-S3cache-Negative"
+
+	// negativeExpiresHeader records when a negative cache entry expires.
+	negativeExpiresHeader = "X-Amz-Meta-S3cache-Negative-Expires"
+)
+
+// SetMiss records a negative cache entry for key, indicating that the
+// resource is known not to exist, which expires after ttl. Until then, Get
+// reports a miss for key without the caller needing to consult the origin,
+// and GetWithError returns ErrNegativeCached. A subsequent Set for key
+// replaces the negative entry. SetMiss replaces an existing entry for key
+// even if SkipIfExists is set.
+func (c *Cache) SetMiss(key string, ttl time.Duration) error {
+	ctx := context.Background()
+	h := c.uploadHeader()
+	h.Del("If-None-Match")
+	c.setProvenance(h, key)
+	h.Set(negativeHeader, "1")
+	h.Set(negativeExpiresHeader, c.now().Add(ttl).UTC().Format(time.RFC3339Nano))
+	err := c.retry(ctx, "Set", key, func() error {
+		return c.store().Put(ctx, c.ObjectKey(key), bytes.NewReader(nil), 0, h)
+	})
+	c.setDone(key, err)
+	return c.wrapError("Set", key, err)
+}
+
+// negative reports whether the object with the response header h is a
+// negative cache entry, and if so, whether it has expired.
+func (c *Cache) negative(h http.Header) (negative, expired bool) {
+	if h.Get(negativeHeader) == "" {
+		return false, false
+	}
+	expires, err := time.Parse(time.RFC3339Nano, h.Get(negativeExpiresHeader))
+	return true, err != nil || !c.now().Before(expires)
+}
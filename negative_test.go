@@ -0,0 +1,38 @@
+package s3cache_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func TestSetMiss(t *testing.T) {
+	for _, skipIfExists := range []bool{false, true} {
+		c := &s3cache.Cache{Store: memstore.New(), SkipIfExists: skipIfExists}
+		if err := c.SetWithError("k", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetMiss("k", time.Minute); err != nil {
+			t.Errorf("SkipIfExists=%v: SetMiss over an existing entry: %v", skipIfExists, err)
+		}
+		if _, ok, err := c.GetWithError("k"); ok || !errors.Is(err, s3cache.ErrNegativeCached) {
+			t.Errorf("SkipIfExists=%v: after SetMiss, got %v, %v; want ErrNegativeCached", skipIfExists, ok, err)
+		}
+		if _, ok := c.Get("k"); ok {
+			t.Errorf("SkipIfExists=%v: Get of a negative entry hit", skipIfExists)
+		}
+	}
+}
+
+func TestSetMissExpires(t *testing.T) {
+	c := &s3cache.Cache{Store: memstore.New()}
+	if err := c.SetMiss("k", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.GetWithError("k"); ok || err != nil {
+		t.Errorf("after the negative entry expired, got %v, %v; want a miss", ok, err)
+	}
+}
@@ -0,0 +1,36 @@
+package s3cache
+
+import (
+	"net/url"
+	"strings"
+)
+
+// NormalizeURL canonicalizes a cache key that is a URL, for use as a
+// Cache's Normalize function, so that URLs that differ only in the case of
+// their scheme and host, a default port, the order of their query
+// parameters, or their fragment map to the same cache entry. Keys of the
+// form "METHOD URL", as httpcache uses for requests other than GET, are
+// normalized likewise. Keys that are not absolute URLs are returned
+// unchanged.
+func NormalizeURL(key string) string {
+	if i := strings.IndexByte(key, ' '); i >= 0 {
+		return key[:i+1] + NormalizeURL(key[i+1:])
+	}
+	u, err := url.Parse(key)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return key
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	// Encode sorts the parameters by name, keeping the order of the values
+	// of each.
+	u.RawQuery = u.Query().Encode()
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
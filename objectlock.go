@@ -0,0 +1,59 @@
+package s3cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Object Lock retention modes, for the ObjectLockMode field of Cache.
+const (
+	// ObjectLockGovernance protects cache entries from deletion or
+	// overwriting by users without the s3:BypassGovernanceRetention
+	// permission until their retention period ends.
+	ObjectLockGovernance = "GOVERNANCE"
+
+	// ObjectLockCompliance protects cache entries from deletion or
+	// overwriting by any user, including the root user, until their
+	// retention period ends.
+	ObjectLockCompliance = "COMPLIANCE"
+)
+
+// ErrObjectLocked is returned, wrapped together with the error from S3,
+// when S3 denies the deletion of a cache entry stored under Object Lock.
+var ErrObjectLocked = errors.New("s3cache: object is locked")
+
+// objectLocked reports whether the Cache stores entries under Object Lock.
+func (c *Cache) objectLocked() bool {
+	return c.ObjectLockMode != "" || c.ObjectLockLegalHold
+}
+
+// setObjectLock sets the Object Lock headers, if any, with which cache
+// entries are stored in h.
+func (c *Cache) setObjectLock(h http.Header) {
+	if c.ObjectLockMode != "" {
+		h.Set("X-Amz-Object-Lock-Mode", c.ObjectLockMode)
+		h.Set("X-Amz-Object-Lock-Retain-Until-Date", c.now().Add(c.ObjectLockRetention).UTC().Format(time.RFC3339))
+	}
+	if c.ObjectLockLegalHold {
+		h.Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+	}
+}
+
+// objectLockedHeader reports whether h stores an object under Object Lock,
+// in which case S3 requires the upload to carry a Content-MD5 header.
+func objectLockedHeader(h http.Header) bool {
+	return h.Get("X-Amz-Object-Lock-Mode") != "" || h.Get("X-Amz-Object-Lock-Legal-Hold") == "ON"
+}
+
+// lockedError returns err marked as ErrObjectLocked if it is S3's denial of
+// a deletion and the Cache stores entries under Object Lock, and err
+// otherwise.
+func (c *Cache) lockedError(err error) error {
+	var e *StatusError
+	if c.objectLocked() && errors.As(err, &e) && e.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %w", ErrObjectLocked, err)
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package s3cache
+
+import (
+	"net/http"
+
+	"github.com/sqs/s3"
+)
+
+// An Option configures a Cache created by NewWithOptions.
+type Option func(*Cache)
+
+// WithCredentials sets the AWS credentials used to sign requests, in place
+// of those read from the environment.
+func WithCredentials(accessKey, secretKey string) Option {
+	return func(c *Cache) {
+		c.Config.Keys = &s3.Keys{AccessKey: accessKey, SecretKey: secretKey}
+	}
+}
+
+// WithPrefix sets the Cache's Prefix.
+func WithPrefix(prefix string) Option {
+	return func(c *Cache) { c.Prefix = prefix }
+}
+
+// WithHTTPClient sets the Cache's HTTPClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Cache) { c.HTTPClient = client }
+}
+
+// WithStorageClass sets the Cache's StorageClass.
+func WithStorageClass(storageClass string) Option {
+	return func(c *Cache) { c.StorageClass = storageClass }
+}
+
+// WithTags sets the Cache's Tags.
+func WithTags(tags map[string]string) Option {
+	return func(c *Cache) { c.Tags = tags }
+}
+
+// WithKeyFunc sets the Cache's KeyFunc.
+func WithKeyFunc(keyFunc func(key string) string) Option {
+	return func(c *Cache) { c.KeyFunc = keyFunc }
+}
+
+// WithNormalize sets the Cache's Normalize function.
+func WithNormalize(normalize func(key string) string) Option {
+	return func(c *Cache) { c.Normalize = normalize }
+}
+
+// WithKeySuffix sets the Cache's KeySuffix.
+func WithKeySuffix(suffix string) Option {
+	return func(c *Cache) { c.KeySuffix = suffix }
+}
+
+// NewWithOptions is like New, but it applies opts to the returned Cache and
+// returns an error if bucketURL is malformed (see NewValidated).
+func NewWithOptions(bucketURL string, opts ...Option) (*Cache, error) {
+	c, err := NewValidated(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
@@ -0,0 +1,65 @@
+package s3cache
+
+import (
+	"net/url"
+	"strings"
+)
+
+// maxPathKeyLen is the length beyond which PathKey hashes keys, leaving
+// room within S3's limit on object key length for Prefix and suffixes.
+const maxPathKeyLen = 900
+
+// PathKey maps a cache key that is a URL to an object key that mirrors the
+// URL's host and path hierarchy, for use as a Cache's KeyFunc, so that
+// entries can be browsed, listed and expired by path. For example, the
+// entry for "https://example.com/api/v1/users/123?fields=name" is stored
+// under "example.com/api/v1/users/123!fields%3Dname".
+//
+// Each path segment is percent-encoded so that only letters, digits and
+// "-", "_", "." and "~" appear unescaped, and the query, if any, is appended
+// to the last segment after a "!". Empty segments are written as "!", and
+// URLs with schemes other than https are stored under "scheme!host". Keys
+// that are not absolute URLs are stored under "!" followed by the encoded
+// key, and keys whose object keys would be too long for S3 under "!!"
+// followed by the MD5 hash of the key. The mapping is one-to-one, except
+// that URLs that differ only in their fragment, in having an empty query
+// ("?") or none, or in having an empty path or "/", map to the same object
+// key.
+func PathKey(key string) string {
+	objectKey := pathKey(key)
+	if len(objectKey) > maxPathKeyLen {
+		return "!!" + cacheKeyToObjectKey(key)
+	}
+	return objectKey
+}
+
+func pathKey(key string) string {
+	u, err := url.Parse(key)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Opaque != "" {
+		return "!" + uriEncode(key, true)
+	}
+	root := uriEncode(u.Host, true)
+	if u.Scheme != "https" {
+		root = uriEncode(u.Scheme, true) + "!" + root
+	}
+	segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	for i, seg := range segments {
+		if s, err := url.PathUnescape(seg); err == nil {
+			seg = s
+		}
+		segments[i] = readableKey(seg)
+	}
+	last := len(segments) - 1
+	switch {
+	case u.RawQuery != "":
+		segments[last] += "!" + uriEncode(u.RawQuery, true)
+	case segments[last] == "":
+		segments[last] = "!"
+	}
+	for i, seg := range segments[:last] {
+		if seg == "" {
+			segments[i] = "!"
+		}
+	}
+	return root + "/" + strings.Join(segments, "/")
+}
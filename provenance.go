@@ -0,0 +1,62 @@
+package s3cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// provenanceKeyHeader records the cache key of an entry stored with
+	// RecordProvenance.
+	provenanceKeyHeader = "X-Amz-Meta-Cache-Key"
+
+	// provenanceKeyHashHeader records the SHA-256 digest of the cache key
+	// of an entry whose key was too long to record in full.
+	provenanceKeyHashHeader = "X-Amz-Meta-Cache-Key-Sha256"
+
+	provenanceHostHeader = "X-Amz-Meta-Written-By"
+	provenanceTimeHeader = "X-Amz-Meta-Written-At"
+
+	// maxProvenanceKeyLen is the length of the longest cache key recorded
+	// in full, which leaves room for other metadata within S3's limit of 2
+	// KB of user-defined metadata per object.
+	maxProvenanceKeyLen = 1024
+)
+
+// setProvenance records in h the provenance of the cache entry for key, if
+// RecordProvenance is set and key is known: the key, the host writing the
+// entry and the current time. Bytes of key other than printable ASCII are
+// percent-encoded, as header values cannot hold them. A key longer than
+// maxProvenanceKeyLen is truncated, and its SHA-256 digest recorded too.
+func (c *Cache) setProvenance(h http.Header, key string) {
+	if !c.RecordProvenance || key == "" {
+		return
+	}
+	const hexDigits = "0123456789ABCDEF"
+	var b []byte
+	truncated := false
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		enc := []byte{ch}
+		if ch < 0x20 || ch >= 0x7f {
+			enc = []byte{'%', hexDigits[ch>>4], hexDigits[ch&15]}
+		}
+		if len(b)+len(enc) > maxProvenanceKeyLen {
+			truncated = true
+			break
+		}
+		b = append(b, enc...)
+	}
+	if truncated {
+		sum := sha256.Sum256([]byte(key))
+		h.Set(provenanceKeyHashHeader, hex.EncodeToString(sum[:]))
+	}
+	h.Set(provenanceKeyHeader, string(b))
+	if host, err := os.Hostname(); err == nil {
+		h.Set(provenanceHostHeader, host)
+	}
+	h.Set(provenanceTimeHeader, c.now().UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,108 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+var (
+	// ErrInvalidRange is returned by GetRange when the requested range does
+	// not overlap the cache entry.
+	ErrInvalidRange = errors.New("s3cache: requested range is not satisfiable")
+
+	// ErrRangeCompressed is returned by GetRange when the cache entry is
+	// stored compressed, so byte ranges of the object do not correspond to
+	// byte ranges of the entry.
+	ErrRangeCompressed = errors.New("s3cache: cannot get a byte range of a compressed cache entry")
+)
+
+// GetRange is like GetWithError, but it returns only bytes start through end
+// (inclusive) of the cache entry, using an S3 range request. If end is past
+// the end of the entry, the returned bytes stop at the end of the entry. If
+// start is past the end of the entry, it returns ErrInvalidRange.
+func (c *Cache) GetRange(key string, start, end int64) (resp []byte, ok bool, err error) {
+	if start < 0 || end < start {
+		return nil, false, c.wrapError("Get", key, fmt.Errorf("invalid range %d-%d", start, end))
+	}
+	ctx := context.Background()
+	err = c.retry(ctx, "Get", key, func() error {
+		resp, ok, err = c.getRange(ctx, key, start, end)
+		return err
+	})
+	switch {
+	case err == ErrNegativeCached:
+		c.onMiss(key)
+	case skipped(err):
+		c.onSkip("Get", key, err)
+	case err != nil:
+		c.onError("Get", key, err)
+	case ok:
+		c.onHit(key)
+	default:
+		c.onMiss(key)
+	}
+	return resp, ok, c.wrapError("Get", key, err)
+}
+
+func (c *Cache) getRange(ctx context.Context, key string, start, end int64) ([]byte, bool, error) {
+	h := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}}
+	objectKey := c.ObjectKey(key)
+	body, rh, err := c.store().Get(ctx, objectKey, h)
+	if c.Dedup && rangeNotSatisfiable(err) {
+		// No range of the empty pointer object of a deduplicated entry is
+		// satisfiable, so check whether the object is one.
+		if rh, err = c.store().Head(ctx, objectKey); err == nil && rh != nil {
+			if rh.Get(blobHeader) == "" {
+				return nil, false, ErrInvalidRange
+			}
+			body = ioutil.NopCloser(bytes.NewReader(nil))
+		}
+	}
+	if rangeNotSatisfiable(err) {
+		return nil, false, ErrInvalidRange
+	}
+	if err != nil || body == nil {
+		return nil, false, err
+	}
+	defer body.Close()
+	if negative, expired := c.negative(rh); negative {
+		if expired {
+			return nil, false, nil
+		}
+		return nil, false, ErrNegativeCached
+	}
+	if c.expired(rh) {
+		c.expire(ctx, key, objectKey)
+		return nil, false, nil
+	}
+	if sum := rh.Get(blobHeader); sum != "" {
+		body.Close()
+		body, rh, err = c.store().Get(ctx, c.blobKey(sum), h)
+		if rangeNotSatisfiable(err) {
+			return nil, false, ErrInvalidRange
+		}
+		if err != nil || body == nil {
+			return nil, false, err
+		}
+		defer body.Close()
+	}
+	if c.compression(rh) != compressionNone {
+		return nil, false, ErrRangeCompressed
+	}
+	resp, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp, true, nil
+}
+
+// rangeNotSatisfiable reports whether err is S3's response to a range
+// request for a range that does not overlap the object.
+func rangeNotSatisfiable(err error) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable
+}
@@ -0,0 +1,47 @@
+package s3cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter is the state of a Cache's rate limiter, which schedules requests
+// at intervals of 1/RequestsPerSecond, allowing bursts of up to one second's
+// worth of requests.
+type limiter struct {
+	mu   sync.Mutex
+	next time.Time // when the next request may be sent
+}
+
+// wait blocks until a request may be sent without exceeding
+// RequestsPerSecond, or until ctx is done, in which case it returns ctx's
+// error.
+func (c *Cache) wait(ctx context.Context) error {
+	if c.RequestsPerSecond <= 0 {
+		return nil
+	}
+	interval := time.Second / time.Duration(c.RequestsPerSecond)
+	l := &c.limiter
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	at := l.next
+	l.next = l.next.Add(interval)
+	l.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,27 @@
+package s3cache
+
+import "errors"
+
+var (
+	// ErrReadOnly is returned by operations that would write to a Cache
+	// whose ReadOnly field is set, which are skipped.
+	ErrReadOnly = errors.New("s3cache: cache is read-only")
+
+	// ErrWriteOnly is returned by operations that would read from a Cache
+	// whose WriteOnly field is set, which are skipped.
+	ErrWriteOnly = errors.New("s3cache: cache is write-only")
+)
+
+// permit returns ErrReadOnly or ErrWriteOnly if the operation op ("Get"
+// for reads, or another operation for writes) is not permitted by ReadOnly
+// or WriteOnly, and nil otherwise.
+func (c *Cache) permit(op string) error {
+	if op == "Get" {
+		if c.WriteOnly {
+			return ErrWriteOnly
+		}
+	} else if c.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package s3cache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// retry calls fn, which performs the operation op on the cache entry for
+// key, until it succeeds, fails with an error that is not retryable, or
+// c.MaxRetries retries have been made or the retry budget is exhausted.
+// Each call waits for the rate limit set by c.RequestsPerSecond. It returns
+// the error from the last call to fn, or without calling fn, ErrReadOnly or
+// ErrWriteOnly if op is not permitted, or ErrCircuitOpen if the circuit
+// breaker is open. An operation that made a multipart upload with ctx is
+// not retried, since the upload retries its own requests.
+func (c *Cache) retry(ctx context.Context, op, key string, fn func() error) error {
+	if err := c.permit(op); err != nil {
+		return err
+	}
+	if err := c.breakerAllow(); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		if err := c.wait(ctx); err != nil {
+			c.breakerCancel()
+			return err
+		}
+		err := fn()
+		if err == nil || attempt >= c.MaxRetries || ctx.Err() != nil || !retryable(err) || uploadedParts(ctx) || !c.spendRetry() {
+			c.breakerDone(op, key, err)
+			c.setLastError(err)
+			return err
+		}
+		delay := c.retryDelay(attempt, err)
+		c.logRetry(op, key, err, attempt+1, delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			c.breakerDone(op, key, err)
+			c.setLastError(err)
+			return err
+		}
+	}
+}
+
+// uploadedParts reports whether a multipart upload was made with ctx, as
+// recorded by putMultipart.
+func uploadedParts(ctx context.Context) bool {
+	p, ok := ctx.Value(uploadedInParts{}).(*bool)
+	return ok && *p
+}
+
+// withTimeout returns a context derived from ctx that is cancelled after
+// the timeout for op, if one is set: c.ReadTimeout for Get and
+// c.WriteTimeout for other operations, or else c.Timeout.
+func (c *Cache) withTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	switch {
+	case op == "Get" && c.ReadTimeout > 0:
+		timeout = c.ReadTimeout
+	case op != "Get" && c.WriteTimeout > 0:
+		timeout = c.WriteTimeout
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// backoff returns the delay before the retry following the given (0-based)
+// attempt: a random duration of up to RetryBaseDelay * 2^attempt.
+func (c *Cache) backoff(attempt int) time.Duration {
+	d := c.RetryBaseDelay
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	for i := 0; i < attempt && d < time.Minute; i++ {
+		d *= 2
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+// retryDelay returns the delay before retrying the given (0-based) attempt,
+// which failed with err. If S3 throttled the attempt, the delay is that of
+// throttledBackoffShift attempts later, to give S3 time to scale.
+func (c *Cache) retryDelay(attempt int, err error) time.Duration {
+	if errors.Is(err, ErrThrottled) {
+		attempt += throttledBackoffShift
+	}
+	return c.backoff(attempt)
+}
+
+// throttledBackoffShift is the number of doublings by which the backoff
+// after a throttled attempt exceeds that after other failures.
+const throttledBackoffShift = 3
+
+// retryable reports whether an operation that failed with err may succeed
+// if it is retried: if S3 was throttled or failed with a server error, or
+// the request failed at the network level.
+func retryable(err error) bool {
+	if err == ErrStaleRead {
+		return true
+	}
+	return unavailable(err)
+}
+
+// unavailable reports whether err indicates that S3 is unavailable or
+// overloaded, rather than that the request itself was at fault.
+func unavailable(err error) bool {
+	switch CategoryOf(err) {
+	case CategoryThrottled, CategoryServerError:
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
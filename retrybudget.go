@@ -0,0 +1,52 @@
+package s3cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults for RetryBudget and RetryBudgetRefill, which are generous enough
+// not to limit retries in normal operation.
+const (
+	defaultRetryBudget       = 100
+	defaultRetryBudgetRefill = 10
+)
+
+// retryBudget is the state of a Cache's retry budget, a token bucket from
+// which each retry takes a token.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+// spendRetry takes a token from the Cache's retry budget and reports
+// whether one was available, i.e., whether a retry may be made.
+func (c *Cache) spendRetry() bool {
+	if c.RetryBudget < 0 {
+		return true
+	}
+	size := float64(c.RetryBudget)
+	if size == 0 {
+		size = defaultRetryBudget
+	}
+	refill := c.RetryBudgetRefill
+	if refill <= 0 {
+		refill = defaultRetryBudgetRefill
+	}
+	b := &c.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = size
+	} else if b.tokens += now.Sub(b.last).Seconds() * refill; b.tokens > size {
+		b.tokens = size
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -3,21 +3,42 @@
 package s3cache // import "sourcegraph.com/sourcegraph/s3cache"
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sqs/s3"
 	"github.com/sqs/s3/s3util"
 )
 
 // Cache objects store and retrieve data using Amazon S3.
+//
+// Cache entries are opaque: they are stored and returned byte for byte,
+// whatever they contain, and are never treated as text. When Gzip or
+// Compress is set, entries are compressed in S3 but returned as they were
+// stored.
+//
+// A Cache is safe for concurrent use by multiple goroutines. Its fields are
+// read, but never modified, by its methods; they must not be modified while
+// any method is in progress. A Cache must not be copied after first use.
 type Cache struct {
 	// Config is the Amazon S3 configuration.
 	Config s3util.Config
@@ -25,79 +46,1387 @@ type Cache struct {
 	// BucketURL is the URL to the bucket on Amazon S3, which includes the
 	// bucket name and the AWS region. Example:
 	// "https://s3-us-west-2.amazonaws.com/mybucket".
+	//
+	// S3-compatible services (such as MinIO, DigitalOcean Spaces or Ceph)
+	// may be used by pointing BucketURL at their endpoint, e.g.
+	// "http://minio.internal:9000/mybucket", and setting PathStyle.
 	BucketURL string
 
+	// PathStyle indicates that BucketURL uses path-style addressing, with
+	// the bucket name as the first path segment, on a host other than
+	// Amazon S3's. Requests signed with SignatureV2 are then signed with
+	// BucketURL's host as the service domain. It is not needed for
+	// path-style Amazon S3 URLs.
+	PathStyle bool
+
+	// Region is the AWS region of the bucket (e.g., "ap-southeast-3"), with
+	// which requests are signed. If empty, the region is derived from
+	// BucketURL if it is an Amazon S3 endpoint, and otherwise taken from the
+	// AWS_REGION environment variable, defaulting to us-east-1.
+	Region string
+
+	// SignatureV2 indicates whether requests should be signed with the
+	// legacy AWS Signature Version 2, for S3-compatible services that do
+	// not support Signature Version 4. Amazon S3 regions launched since
+	// 2014 only accept Signature Version 4, which is used by default.
+	SignatureV2 bool
+
+	// DualStack indicates whether requests should be sent to the
+	// dual-stack (IPv4 and IPv6) form of BucketURL's Amazon S3 endpoint,
+	// e.g. "mybucket.s3.dualstack.us-west-2.amazonaws.com" for
+	// "mybucket.s3.us-west-2.amazonaws.com". Requests are signed for the
+	// dual-stack host. A dual-stack BucketURL may also be used directly.
+	// DualStack has no effect on endpoints other than Amazon S3's.
+	DualStack bool
+
+	// Accelerate indicates whether requests should be sent to the bucket's
+	// S3 Transfer Acceleration endpoint, e.g.
+	// "mybucket.s3-accelerate.amazonaws.com", which can speed up reads and
+	// writes from far away regions. The bucket must have Transfer
+	// Acceleration enabled, and its name must be DNS-compliant and contain
+	// no periods. Requests are addressed in virtual-hosted style and signed
+	// with Signature Version 4 for the accelerate host, in the bucket's
+	// region, so Region should be set unless BucketURL names it. Accelerate
+	// cannot be combined with SignatureV2. With DualStack, the dual-stack
+	// accelerate endpoint is used.
+	Accelerate bool
+
 	// Gzip indicates whether cache entries should be gzipped in Set and
 	// gunzipped in Get. If true, cache entry keys will have the suffix ".gz"
 	// appended.
 	Gzip bool
+
+	// Compress indicates whether cache entries should be gzipped in Set.
+	// Unlike Gzip, object keys are unchanged and compressed objects are
+	// stored with "Content-Encoding: gzip".
+	//
+	// Set records the codec with which it compressed each entry ("gzip",
+	// or "none") as "X-Amz-Meta-Compression" metadata, and Get decompresses
+	// entries with their recorded codec, regardless of Gzip, Compress and
+	// CompressBody, so that entries remain readable after the settings
+	// change. Entries written before codecs were recorded are decompressed
+	// based on their stored Content-Encoding, or if Gzip is set.
+	Compress bool
+
+	// CompressMinSize, if positive, makes Compress selective: Set only
+	// compresses cache entries of at least CompressMinSize bytes whose
+	// content (the body, for serialized HTTP responses) is not already
+	// compressed, such as gzip-encoded responses and JPEG or PNG images, as
+	// detected by their Content-Encoding or magic bytes, and stores entries
+	// uncompressed if compressing them does not make them smaller. It does
+	// not apply to SetReader or to Gzip, which always compresses.
+	CompressMinSize int
+
+	// CompressBody indicates whether Set should gzip only the bodies of
+	// cache entries that are serialized HTTP responses, storing their
+	// status lines and headers uncompressed at the start of the object, so
+	// that they remain readable when the object is inspected. Get restores
+	// the entries exactly as they were stored. It takes precedence over
+	// Compress for such entries, and is subject to CompressMinSize, but it
+	// does not apply with Gzip, which compresses whole entries.
+	CompressBody bool
+
+	// Decoders maps content codings (e.g. "br" or "zstd") to functions that
+	// return a reader decoding a body with that coding, with which
+	// GetDecoded decodes the bodies of cached HTTP responses. Get also uses
+	// them to decompress entries recorded as compressed with a codec other
+	// than gzip, such as "zstd". Gzip is decoded without a Decoder.
+	Decoders map[string]func(r io.Reader) (io.Reader, error)
+
+	// DefaultContentType, if set, is the Content-Type with which cache
+	// entries are stored when it is not known. Set stores entries that are
+	// serialized HTTP responses, as written by httpcache, with the
+	// Content-Type of the response, so that objects can be viewed in the S3
+	// console and served by presigned URLs.
+	DefaultContentType string
+
+	// Prefix, if set, is prepended to the object key of every cache entry,
+	// so that entries are stored under e.g. "myservice/<md5>". Prefix and
+	// key are joined with a single slash, whether or not Prefix already
+	// ends with one.
+	Prefix string
+
+	// KeyVersion, if set, is the version of the format of cache entries,
+	// which follows Prefix in their object keys (e.g., "myservice/v3/<md5>"),
+	// so that changing it switches the Cache to a fresh set of entries
+	// without deleting the old ones, which a lifecycle rule can expire
+	// later. Operations on the whole cache, such as Clear and Keys, apply
+	// only to the entries of the current version.
+	KeyVersion string
+
+	// Normalize, if non-nil, canonicalizes cache keys before they are
+	// mapped to S3 object keys, so that equivalent keys share a cache entry;
+	// see NormalizeURL. Changing Normalize, or using a different one for
+	// the same bucket, makes entries stored under other forms of their keys
+	// unreachable.
+	Normalize func(key string) string
+
+	// KeyFunc, if non-nil, maps cache keys to S3 object keys in place of the
+	// default MD5 hashing. It must return valid S3 object keys and should be
+	// collision-resistant, since two cache keys that map to the same object
+	// key will overwrite each other's entries. See PathKey for a layout
+	// that mirrors the paths of URL keys.
+	KeyFunc func(key string) string
+
+	// ReadableKeys indicates whether cache entries should be stored under
+	// their cache keys, percent-encoded so that only letters, digits and
+	// "-", "_", "." and "~" appear unescaped (e.g.,
+	// "https%3A%2F%2Fexample.com%2Fa"), instead of under the MD5 hashes of
+	// their keys, so that they can be inspected in the S3 console. Entries
+	// whose object keys would exceed S3's limit of 1024 bytes, and the entry
+	// for the empty key, are stored under the hash as usual. KeyFunc takes
+	// precedence over ReadableKeys.
+	ReadableKeys bool
+
+	// KeySuffix, if set, is appended to the object key of every cache
+	// entry, e.g. ".json" to store entries as "<md5>.json", so that objects
+	// carry an extension matching their contents when browsed or served
+	// directly. It precedes the ".gz" suffix added by Gzip.
+	KeySuffix string
+
+	// ShardLevels is the number of levels of subdirectories into which
+	// object keys are sharded, to spread load across S3 partitions. Each
+	// level is named after the next two hex digits of the MD5 hash of the
+	// cache key, so with ShardLevels = 2, entries are stored under
+	// "ab/cd/<key>". If zero, object keys are not sharded.
+	ShardLevels int
+
+	// HTTPClient, if non-nil, is used for all requests to S3. It takes
+	// precedence over Config.Client. If both are nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+
+	// PreSignHook and RequestHook, if non-nil, are called with each request
+	// to S3 before it is sent, e.g. to add a header required by a gateway
+	// in front of S3. PreSignHook is called before the request is signed,
+	// and RequestHook after, so that headers added by RequestHook are not
+	// signed. Of the headers PreSignHook adds, Signature Version 4 signs
+	// those named "X-Amz-*", Content-MD5, Content-Type, Range and
+	// If-None-Match; Signature Version 2 signs "X-Amz-*" headers and the
+	// Content-MD5 and Content-Type. RequestHook must not change the URL,
+	// body or signed headers, which would invalidate the signature. The
+	// hooks are called for every attempt of a retried request. If either
+	// returns an error, the request is not sent, and the operation fails
+	// with the error.
+	PreSignHook func(req *http.Request) error
+	RequestHook func(req *http.Request) error
+
+	// Anonymous indicates that requests should not be signed, for access to
+	// public buckets without AWS credentials. An anonymous Cache is read-only:
+	// operations that would write to the bucket fail with ErrAnonymousWrite.
+	// Otherwise, operations fail with ErrCredentialsMissing if the Cache has
+	// no credentials.
+	Anonymous bool
+
+	// Logger, if non-nil, receives structured logs of the Cache's
+	// operations: hits and misses at debug level, retries and skipped writes
+	// at warn level, and failures at error level. Records have the
+	// attributes "op", "key" and, where applicable, "status" and "err".
+	Logger *slog.Logger
+
+	// Tracer, if non-nil, traces Get, Set and Delete operations, e.g. as
+	// OpenTelemetry spans.
+	Tracer Tracer
+
+	// Store, if non-nil, is the object storage in which entries are kept, in
+	// place of the S3 bucket configured by the other fields. See Store.
+	Store Store
+
+	// Credentials, if non-nil, provides the credentials used to sign
+	// requests, in place of Config.Keys. See IAMCredentials.
+	Credentials CredentialsProvider
+
+	// ServerSideEncryption, if set, is the server-side encryption algorithm
+	// ("AES256" or "aws:kms") with which S3 encrypts cache entries at rest.
+	// S3 decrypts objects transparently on Get.
+	ServerSideEncryption string
+
+	// SSEKMSKeyID is the ID of the AWS KMS key used to encrypt cache entries
+	// when ServerSideEncryption is "aws:kms". If empty, S3 uses the
+	// account's default KMS key.
+	SSEKMSKeyID string
+
+	// SSEKMSEncryptionContext, if non-empty, is the KMS encryption context
+	// with which cache entries are encrypted when ServerSideEncryption is
+	// "aws:kms". It is sent when entries are stored, including by multipart
+	// uploads and CopyFrom. S3 stores the context with each object and
+	// supplies it to KMS itself when the object is read, so Get sends no
+	// context (S3 does not accept one on GET requests); an AccessDenied
+	// error from KMS on Get instead means that the requester's key policy or
+	// IAM policy does not allow kms:Decrypt with the stored context.
+	//
+	// The policies must allow kms:GenerateDataKey (for Set) and kms:Decrypt
+	// (for Get) with a condition on the context, such as
+	// "kms:EncryptionContext:team": "search". S3 also adds an "aws:s3:arn"
+	// entry to the context, so conditions that constrain every key of the
+	// context (ForAllValues on kms:EncryptionContextKeys) must allow that
+	// key too.
+	SSEKMSEncryptionContext map[string]string
+
+	// SSECustomerKey, if set, is the 256-bit key with which S3 encrypts cache
+	// entries at rest using SSE-C. Unlike with ServerSideEncryption, S3 does
+	// not keep the key, so the Cache sends it with every request that reads
+	// or writes an entry, and entries can only be read with the key that
+	// wrote them. Reading an SSE-C entry without a key fails with
+	// ErrSSECustomerKey. S3 only accepts SSE-C requests over HTTPS.
+	SSECustomerKey []byte
+
+	// StorageClass, if set, is the S3 storage class (e.g. "STANDARD_IA",
+	// "ONEZONE_IA", "GLACIER_IR" or "INTELLIGENT_TIERING"; see the
+	// StorageClass constants) in which cache entries are stored. It is
+	// passed to S3 as is, so an unknown storage class results in an error
+	// from S3. If empty, S3 uses the STANDARD storage class.
+	//
+	// With INTELLIGENT_TIERING, S3 moves rarely read entries to cheaper
+	// access tiers, from which they are read as usual. If the bucket's
+	// Intelligent-Tiering configuration also archives entries (e.g., those
+	// with a tag set by Tags), archived entries cannot be read until they
+	// are restored, and Get treats them as misses.
+	StorageClass string
+
+	// ACL, if set, is the canned ACL (e.g. "private", "public-read" or
+	// "bucket-owner-full-control") with which cache entries are stored. If
+	// empty, the bucket's default applies.
+	ACL string
+
+	// Metadata holds user-defined metadata stored with every cache entry, as
+	// "X-Amz-Meta-<name>" headers.
+	Metadata map[string]string
+
+	// RecordProvenance indicates whether Set should store the provenance of
+	// each cache entry as metadata, to trace objects, whose keys are
+	// hashed by default, back to their cache keys: the cache key, as
+	// "X-Amz-Meta-Cache-Key", the hostname of the writer, as
+	// "X-Amz-Meta-Written-By", and the time of the write, as
+	// "X-Amz-Meta-Written-At". Cache keys longer than 1024 bytes are
+	// truncated, and their SHA-256 digest is stored as
+	// "X-Amz-Meta-Cache-Key-Sha256". Entries stored by WarmFromDir, whose
+	// cache keys are not known, have no provenance.
+	RecordProvenance bool
+
+	// Index indicates whether to record the cache key of each entry that
+	// is stored in an index, which LookupOriginalKey reads to map object
+	// keys back to cache keys. Entries are flushed in batches to new index
+	// objects under "index/" in Prefix: once IndexBatchSize entries are
+	// pending (default 1000), IndexFlushInterval after the first pending
+	// entry was recorded (default 1 minute), on FlushIndex, and on Close.
+	// Entries still pending when the process exits are lost. Index objects
+	// are deleted by Clear, but not by PruneOlderThan.
+	Index              bool
+	IndexBatchSize     int
+	IndexFlushInterval time.Duration
+
+	// Tags holds S3 object tags applied to every cache entry. Unlike
+	// Metadata, tags can be used in lifecycle rules and cost allocation.
+	Tags map[string]string
+
+	// ObjectLockMode, if set, is the S3 Object Lock retention mode
+	// (ObjectLockGovernance or ObjectLockCompliance) under which cache
+	// entries are stored, for ObjectLockRetention from when they are
+	// stored. ObjectLockLegalHold, if set, also places a legal hold on each
+	// entry, which protects it until the hold is removed. Both require a
+	// bucket with Object Lock enabled, and that S3 be sent the MD5 digest
+	// of every entry, as with VerifyUploads.
+	//
+	// Object Lock requires a versioned bucket, in which Delete adds a delete
+	// marker that hides the locked entry rather than removing it. If S3
+	// denies a deletion, the error reported to OnError wraps
+	// ErrObjectLocked.
+	ObjectLockMode      string
+	ObjectLockRetention time.Duration
+	ObjectLockLegalHold bool
+
+	// OnHit, OnMiss and OnError, if non-nil, are called when Get finds a
+	// cache entry, when Get finds no cache entry, and when an operation
+	// ("Get", "Set" or "Delete") fails, respectively. They are called
+	// synchronously on the goroutine performing the operation, so they
+	// should not block.
+	OnHit   func(key string)
+	OnMiss  func(key string)
+	OnError func(op string, key string, err error)
+
+	// OnSkip, if non-nil, is called when an operation is deliberately not
+	// performed, with the reason it was skipped (such as ErrTooLarge for a
+	// Set, or ErrCircuitOpen). Like the other callbacks, it is called
+	// synchronously.
+	OnSkip func(op string, key string, reason error)
+
+	// FailMode determines whether the methods that return errors, such as
+	// GetWithError, SetWithError and DeleteWithError, return errors when
+	// S3 fails or cannot be reached (FailClosed, the default), or report a
+	// miss or success instead (FailOpen). Errors caused by the caller or by
+	// the Cache's configuration are returned in either mode, and OnError
+	// is called in either mode. Get, Set and Delete always fail open.
+	FailMode FailMode
+
+	// OnComplete, if non-nil, is called when a Get, Set or Delete (or one
+	// of their Context and WithError variants) ends, whether it succeeded
+	// or failed, with the size of the cache entry read or written, the
+	// time the operation took, including retries, and the error with which
+	// it failed, if any. It is called synchronously.
+	OnComplete func(op string, bytes int, dur time.Duration, err error)
+
+	// MaxRetries is the number of times a Get, Set or Delete is retried,
+	// with exponential backoff and jitter, after it fails with a 5xx
+	// response or a connection error. Cache misses are never retried. A
+	// multipart upload retries each of its requests instead of being
+	// retried as a whole. If zero, operations are not retried.
+	MaxRetries int
+
+	// RetryBaseDelay is the delay before the first retry; each subsequent
+	// retry doubles it. If zero, 100ms is used.
+	RetryBaseDelay time.Duration
+
+	// RetryBudget and RetryBudgetRefill cap the rate of retries across all
+	// of the Cache's operations, so that retries do not amplify the load
+	// on S3 during an outage. Each retry takes one of RetryBudget tokens,
+	// which are replenished at RetryBudgetRefill tokens per second; when
+	// none are left, operations fail with their last error instead of
+	// retrying. If zero, they default to 100 and 10 respectively. If
+	// RetryBudget is negative, retries are not limited.
+	RetryBudget       int
+	RetryBudgetRefill float64
+
+	// BreakerThreshold, if positive, is the number of consecutive operations
+	// that must fail with a 5xx response or a connection error to open the
+	// cache's circuit breaker. While it is open, operations are not
+	// attempted: Get reports a miss, and Set and Delete do nothing, with
+	// ErrCircuitOpen reported to OnSkip. After BreakerCooldown, a single
+	// operation is attempted, which closes the circuit if it succeeds and
+	// reopens it if it fails. ErrCircuitOpen is reported to OnError whenever
+	// the circuit opens.
+	BreakerThreshold int
+
+	// BreakerCooldown is the time for which the circuit breaker stays open.
+	// If zero, 30s is used.
+	BreakerCooldown time.Duration
+
+	// RequestsPerSecond, if positive, limits the rate at which Get, Set,
+	// Delete and their variants send requests to S3, including retries,
+	// allowing bursts of up to one second's worth of requests. S3 throttles
+	// requests to a prefix beyond a few thousand per second. Operations wait
+	// for their turn, or fail if their context is done first. If zero, the
+	// rate is not limited.
+	RequestsPerSecond int
+
+	// ConsistentReads indicates whether Get should check that it reads the
+	// version of a cache entry most recently stored by Set on this Cache,
+	// within ConsistencyWindow of the Set, by comparing ETags. Stale reads
+	// are retried as configured by MaxRetries, and fail with ErrStaleRead if
+	// they persist. Amazon S3 is strongly consistent, so this is only useful
+	// with S3-compatible services that are not. Entries stored in parts or
+	// with SSE-KMS or SSE-C are not checked.
+	ConsistentReads bool
+
+	// ConsistencyWindow is how long after a Set ConsistentReads and
+	// ReadAfterWriteRetries apply. If zero, 5s is used.
+	ConsistencyWindow time.Duration
+
+	// ReadAfterWriteRetries, if positive, is the number of times Get
+	// retries, with backoff starting at RetryBaseDelay, when it finds no
+	// cache entry for a key that Set stored on this Cache within
+	// ConsistencyWindow, before reporting a miss. Some S3-compatible
+	// services do not make new objects visible immediately; Amazon S3 does,
+	// so AWS users do not need this. Misses of other keys are not delayed.
+	ReadAfterWriteRetries int
+
+	// Dedup indicates whether Set should store each distinct cache entry
+	// only once. Entries are stored in blob objects named by the SHA-256
+	// digest of their contents, under "blobs/" in Prefix, and the object of
+	// each cache key holds a pointer to its blob, which Get follows. Delete
+	// only deletes pointers; see CollectBlobs for deleting unused blobs.
+	// Dedup does not apply to SetReader, and saves storage at the cost of a
+	// HEAD request for each Set and an additional GET request for each Get.
+	Dedup bool
+
+	// ReadReplicas, if set, are Caches for replicas of the bucket, such as
+	// in other regions, which Get consults in order when it finds no cache
+	// entry in S3 or fails to read from S3, before FallbackCache. Set and
+	// Delete apply only to this Cache, whose bucket is the primary. A
+	// failure to read from a replica is reported to the replica's OnError.
+	ReadReplicas []*Cache
+
+	// FallbackCache, if non-nil, is consulted by Get when it fails to read
+	// from S3 (but not when it finds no cache entry), so that an S3 outage
+	// does not make every Get a miss. The failure is still reported to
+	// OnError. Delete also deletes entries from FallbackCache.
+	FallbackCache HTTPCache
+
+	// WriteFallback indicates whether Set should also store entries in
+	// FallbackCache, whether or not storing them in S3 succeeds.
+	WriteFallback bool
+
+	// ReadOnly indicates whether the Cache should only read from S3. Set,
+	// Delete and other operations that would write to S3 do nothing, and
+	// return ErrReadOnly, which is reported to OnSkip. Expired entries are
+	// not deleted, even if DeleteExpired is set.
+	ReadOnly bool
+
+	// WriteOnly indicates whether the Cache should only write to S3, e.g.
+	// to warm a cache. Get and other operations that would read from S3
+	// report a miss, and return ErrWriteOnly, which is reported to OnSkip.
+	WriteOnly bool
+
+	// Timeout, if positive, limits the time that Get, Set and Delete (and
+	// their Context and WithError variants) may take, including retries.
+	// Operations that time out fail as if their context's deadline had
+	// passed. It does not apply to GetReader and SetReader, which stream
+	// entries for as long as the caller reads or writes them.
+	Timeout time.Duration
+
+	// ReadTimeout and WriteTimeout, if positive, override Timeout for Get
+	// and for Set and Delete, respectively, so that reads can fail fast
+	// while large uploads are given longer to complete.
+	ReadTimeout, WriteTimeout time.Duration
+
+	// MultipartThreshold, if positive, is the size in bytes above which Set
+	// uploads cache entries in parts, using an S3 multipart upload, so that
+	// large entries are uploaded faster and a failure only requires a part
+	// to be retried. SetReader always uploads entries in parts. Failed
+	// multipart uploads are aborted, so S3 does not keep their parts.
+	MultipartThreshold int64
+
+	// PartSize is the size in bytes of each part of a multipart upload. It
+	// must be at least 5 MiB, which is used if it is smaller. Up to
+	// UploadConcurrency parts are held in memory at once.
+	PartSize int64
+
+	// UploadConcurrency is the maximum number of parts of a multipart upload
+	// that are uploaded at once. If zero, 4 is used.
+	UploadConcurrency int
+
+	// MaxConcurrency is the maximum number of S3 requests that operations
+	// making many requests at once (Clear, DeleteMulti, WarmFromDir,
+	// ExportToDir and multipart uploads) have in flight at once, in total
+	// across all such operations on the Cache. If zero, 32 is used.
+	MaxConcurrency int
+
+	// SkipIfExists indicates whether Set should only store a cache entry if
+	// none exists for its key, by sending "If-None-Match: *" so that S3
+	// rejects the write with 412 Precondition Failed, which is treated as
+	// success. It avoids redundant writes when many callers regenerate the
+	// same entry at once. It relies on S3 conditional writes.
+	SkipIfExists bool
+
+	// CoalesceWrites indicates whether concurrent Sets of the same key
+	// should share a single upload: while one is storing the entry, the
+	// others wait for it to finish and return its result, without storing
+	// their own entry, which is assumed to be the same. Unlike
+	// SkipIfExists, it works within a single Cache in this process, without
+	// relying on S3. SetWithInfo reports that the Sets that waited wrote no
+	// bytes.
+	CoalesceWrites bool
+
+	// MaxObjectSize, if positive, is the size in bytes of the largest cache
+	// entry that Set stores. Larger entries are skipped: SetWithError and
+	// SetReader return ErrTooLarge, and OnSkip is called. SetReader stops
+	// uploading as soon as it has read more than MaxObjectSize bytes.
+	MaxObjectSize int64
+
+	// ShouldCache, if non-nil, is called by Set with each cache entry before
+	// it is stored. If it returns false, the entry is not stored (nor
+	// written to FallbackCache): SetWithError returns ErrNotCacheable, and
+	// OnSkip is called. It lets a single policy keep entries such as
+	// responses with Set-Cookie headers out of the cache. It does not apply
+	// to SetReader and SetReaderSize, which do not have the whole entry in
+	// advance.
+	ShouldCache func(key string, resp []byte) bool
+
+	// VerifyUploads indicates whether Set should send the MD5 digest of each
+	// cache entry in a Content-MD5 header, so that S3 rejects uploads that
+	// were corrupted in transit. It does not apply to SetReader and
+	// SetReaderSize, which do not have the whole entry in advance.
+	VerifyUploads bool
+
+	// ChecksumAlgorithm, if set, is the algorithm (ChecksumCRC32C or
+	// ChecksumSHA256) with which Set computes a checksum of each object it
+	// uploads, which S3 verifies and stores with the object, in addition to
+	// the Content-MD5 sent if VerifyUploads is set. Objects uploaded in
+	// parts, including by SetReader, have a checksum for each part. It does
+	// not affect Get, which neither requests nor checks S3's checksums.
+	ChecksumAlgorithm string
+
+	// VerifyDownloads indicates whether Get should verify each cache entry
+	// against the SHA-256 digest that Set stores with it, treating entries
+	// that do not match as misses and reporting ErrChecksumMismatch to
+	// OnError. Entries stored without a digest, such as those written by
+	// SetReader or by older versions of this package, are not verified.
+	VerifyDownloads bool
+
+	// TTL, if positive, is the maximum age of a cache entry. Get treats
+	// older entries as misses. This is a soft TTL enforced when entries are
+	// read; the objects remain in S3 unless DeleteExpired is set or a bucket
+	// lifecycle rule removes them.
+	//
+	// Set also stores entries with an Expires header TTL in the future,
+	// which S3 returns to readers (such as downstream HTTP caches and
+	// presigned URL clients) but does not act on: S3 only deletes objects
+	// by lifecycle rules. To have S3 delete expired entries, add a
+	// lifecycle rule to the bucket that expires objects under Prefix, or
+	// with one of Tags, a whole number of days (rounded up from TTL) after
+	// their creation.
+	TTL time.Duration
+
+	// RespectCacheControl indicates whether cache entries that are
+	// serialized HTTP responses should expire when the responses become
+	// stale according to the max-age directive of their Cache-Control
+	// header (less their Age), in place of TTL. Set records the expiry with
+	// the entry, and Get treats entries past it as misses; entries without
+	// a max-age directive are subject to TTL. Note that this defeats the
+	// revalidation of stale responses by httpcache, which needs the stale
+	// entries.
+	RespectCacheControl bool
+
+	// NegativeCacheTTL, if positive, is how long Get remembers, in memory,
+	// that it found no cache entry for a key, so that repeated Gets for the
+	// key report misses without requesting the entry from S3 until then.
+	// Storing an entry for the key with this Cache forgets the miss, but
+	// entries stored by other processes are not seen until it expires.
+	// NegativeCacheSize bounds the number of misses remembered, 10000 if
+	// it is not positive. Unlike SetMiss, it does not store anything in S3.
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int
+
+	// DeleteExpired indicates whether Get should delete cache entries that
+	// it finds to be older than TTL, or expired per RespectCacheControl.
+	DeleteExpired bool
+
+	// Clock, if non-nil, is used in place of the system clock for the
+	// Cache's time-dependent behavior: the age and expiry of cache entries
+	// (TTL, RespectCacheControl and SetMiss), the timestamps Set records
+	// (such as with RecordProvenance and ObjectLockRetention), the age of
+	// blobs in CollectBlobs, the consistency window of ConsistentReads and
+	// ReadAfterWriteRetries, the circuit breaker's cooldown, and the expiry
+	// of presigned URLs. Requests are still signed, rate limited and timed
+	// with the system clock, since S3 and real delays depend on it.
+	Clock Clock
+
+	breaker breaker
+	limiter limiter
+	budget  retryBudget
+	lastErr lastError
+	etags   etagCache
+	sem     semaphore
+	writes  writeGroup
+	misses  missCache
+	stats   costStats
+	rotated atomic.Pointer[s3.Keys] // set by SetCredentials
+	index   indexLog
 }
 
+// An HTTPCache is a cache with the methods of httpcache.Cache, such as a
+// Cache or a TieredCache.
+type HTTPCache interface {
+	Get(key string) (resp []byte, ok bool)
+	Set(key string, resp []byte)
+	Delete(key string)
+}
+
+var (
+	_ HTTPCache = (*Cache)(nil)
+	_ HTTPCache = (*TieredCache)(nil)
+	_ HTTPCache = (*AsyncCache)(nil)
+	_ HTTPCache = (*ShardedCache)(nil)
+)
+
 var noLogErrors, _ = strconv.ParseBool(os.Getenv("NO_LOG_S3CACHE_ERRORS"))
 
+// Get returns the cache entry for key. If there is none, or it cannot be
+// retrieved, resp is nil and ok is false. An empty entry, such as a stored
+// 204 response body, is returned as a non-nil empty slice with ok true.
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	rdr, err := s3util.Open(c.url(key), &c.Config)
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but the S3 request is aborted if ctx is cancelled
+// or its deadline passes.
+func (c *Cache) GetContext(ctx context.Context, key string) (resp []byte, ok bool) {
+	resp, ok, err := c.getContext(ctx, key)
 	if err != nil {
-		return []byte{}, false
+		if !noLogErrors && err != ErrNegativeCached && !skipped(err) {
+			log.Printf("s3cache.Get failed: %s", err)
+		}
+		return nil, false
+	}
+	return resp, ok
+}
+
+// GetWithError is like Get, but it distinguishes a cache miss from a failure
+// to retrieve the cache entry. If the entry does not exist, ok is false and
+// err is nil; any other failure is returned as a non-nil err. If the key is
+// negatively cached (see SetMiss), errors.Is(err, ErrNegativeCached) is
+// true. Errors are annotated with the operation and the object key of the
+// entry, and wrap the underlying error, such as a *StatusError, for
+// errors.Is and errors.As.
+func (c *Cache) GetWithError(key string) (resp []byte, ok bool, err error) {
+	resp, ok, err = c.getContext(context.Background(), key)
+	return resp, ok, c.wrapError("Get", key, err)
+}
+
+func (c *Cache) getContext(ctx context.Context, key string) (resp []byte, ok bool, err error) {
+	e, ok, err := c.lookup(ctx, key, false)
+	return e.resp, ok, err
+}
+
+// A found is a cache entry found by lookup: the entry, or a reader that
+// streams it, and the header of its object, which is nil if the entry came
+// from the FallbackCache.
+type found struct {
+	resp []byte
+	rdr  io.ReadCloser
+	meta http.Header
+}
+
+// lookup gets the cache entry for key, or a reader that streams it if
+// stream is true. It is the path shared by the Get methods: it applies the
+// read timeout, reports the operation to the Tracer and the callbacks,
+// consults the miss cache, and on a miss or a failure the ReadReplicas and
+// the FallbackCache. The timeout of a streamed entry lasts until its reader
+// is closed.
+func (c *Cache) lookup(ctx context.Context, key string, stream bool) (e found, ok bool, err error) {
+	ctx, endSpan := c.startSpan(ctx, "Get", key)
+	ctx, cancel := c.withTimeout(ctx, "Get")
+	defer func() {
+		if ok && e.rdr != nil {
+			e.rdr = &cancelReader{e.rdr, cancel}
+		} else {
+			cancel()
+		}
+	}()
+	defer func() { endSpan(spanResult(len(e.resp), ok, err)) }()
+	objectKey := c.ObjectKey(key)
+	if c.recentMiss(objectKey) {
+		c.onMiss(key)
+		return found{}, false, nil
+	}
+	err = c.retry(ctx, "Get", key, func() (err error) {
+		if stream {
+			e.rdr, e.meta, _, err = c.openEntry(ctx, key, nil)
+			ok = e.rdr != nil
+		} else {
+			e.resp, e.meta, ok, err = c.get(ctx, key, nil)
+		}
+		return err
+	})
+	switch {
+	case err == ErrNegativeCached:
+		c.onMiss(key)
+	case skipped(err):
+		c.onSkip("Get", key, err)
+	case err != nil:
+		c.onError("Get", key, err)
+	case ok:
+		c.onHit(key)
+	default:
+		c.onMiss(key)
+	}
+	if !ok && err != ErrNegativeCached && err != ErrWriteOnly {
+		for _, r := range c.ReadReplicas {
+			if re, rok, _ := r.lookup(ctx, key, stream); rok {
+				return re, true, nil
+			}
+		}
+	}
+	if err != nil && err != ErrNegativeCached && err != ErrWriteOnly && c.FallbackCache != nil {
+		if fresp, fok := c.FallbackCache.Get(key); fok {
+			e = found{resp: fresp}
+			if stream {
+				e.rdr = ioutil.NopCloser(bytes.NewReader(fresp))
+			}
+			return e, true, nil
+		}
+	}
+	if !ok && err == nil {
+		c.recordMiss(objectKey)
+	}
+	return e, ok, err
+}
+
+// A cancelReader cancels the context of the request whose body it reads
+// when it is closed.
+type cancelReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// get reads the cache entry for key and the header of its object. The
+// header h holds additional request options for the Store.
+func (c *Cache) get(ctx context.Context, key string, h http.Header) (resp []byte, meta http.Header, ok bool, err error) {
+	rdr, meta, size, err := c.openEntry(ctx, key, h)
+	if err != nil || rdr == nil {
+		return nil, nil, false, err
 	}
 	defer rdr.Close()
-	if c.Gzip {
-		rdr, err = gzip.NewReader(rdr)
-		if err != nil {
-			return nil, false
+	resp, err = readAll(rdr, size)
+	if err == ErrChecksumMismatch {
+		c.onError("Get", key, err)
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if resp == nil {
+		// Distinguish an empty entry from a miss.
+		resp = []byte{}
+	}
+	return resp, meta, true, nil
+}
+
+// GetWithMeta is like GetWithError, but it also returns the metadata of the
+// entry's object, such as its ETag, Last-Modified, X-Amz-Version-Id and
+// X-Amz-Meta-* headers, keyed by canonical header key. Multiple values of a
+// header are joined with commas. If ok is false, meta is nil. An entry
+// served by the FallbackCache has no metadata.
+func (c *Cache) GetWithMeta(key string) (resp []byte, meta map[string]string, ok bool, err error) {
+	e, ok, err := c.lookup(context.Background(), key, false)
+	if ok {
+		meta = make(map[string]string, len(e.meta))
+		for k, vs := range e.meta {
+			meta[http.CanonicalHeaderKey(k)] = strings.Join(vs, ",")
+		}
+	}
+	return e.resp, meta, ok, c.wrapError("Get", key, err)
+}
+
+// GetReader is like GetWithError, but it returns a reader that streams the
+// cache entry instead of reading it into memory. If ok is true, the caller
+// is responsible for closing the reader. The Cache's read timeout applies
+// until the reader is closed.
+func (c *Cache) GetReader(key string) (rdr io.ReadCloser, ok bool, err error) {
+	e, ok, err := c.lookup(context.Background(), key, true)
+	return e.rdr, ok, c.wrapError("Get", key, err)
+}
+
+// openEntry returns a reader for the decompressed cache entry for key, the
+// header of its object, and the size of the entry, or -1 if it is not known
+// in advance. It returns a nil reader and a nil error if there is no such
+// entry. The header h holds additional request options for the Store's Get
+// of the entry's object.
+func (c *Cache) openEntry(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, int64, error) {
+	return c.openObject(ctx, key, c.ObjectKey(key), h)
+}
+
+// openObject is like openEntry, but it reads the cache entry in the object
+// with the given key. Failures are reported for key.
+func (c *Cache) openObject(ctx context.Context, key, objectKey string, reqHeader http.Header) (io.ReadCloser, http.Header, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, -1, err
+	}
+	body, h, err := c.store().Get(ctx, objectKey, reqHeader)
+	for attempt := 0; err == nil && body == nil && attempt < c.ReadAfterWriteRetries && c.recentlyWritten(objectKey); attempt++ {
+		// The object may not be visible yet on an eventually consistent
+		// service.
+		t := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, -1, ctx.Err()
 		}
-		defer rdr.Close()
+		body, h, err = c.store().Get(ctx, objectKey, reqHeader)
 	}
-	resp, err = ioutil.ReadAll(rdr)
+	if err != nil || body == nil {
+		return nil, nil, -1, err
+	}
+	if c.stale(objectKey, h) {
+		body.Close()
+		return nil, nil, -1, ErrStaleRead
+	}
+	if negative, expired := c.negative(h); negative {
+		body.Close()
+		if expired {
+			return nil, nil, -1, nil
+		}
+		return nil, nil, -1, ErrNegativeCached
+	}
+	if c.expired(h) {
+		body.Close()
+		c.expire(ctx, key, objectKey)
+		return nil, nil, -1, nil
+	}
+	meta := h
+	if sum := h.Get(blobHeader); sum != "" {
+		body.Close()
+		if body, h, err = c.store().Get(ctx, c.blobKey(sum), nil); err != nil || body == nil {
+			return nil, nil, -1, err
+		}
+	}
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
 	if err != nil {
-		if !noLogErrors {
-			log.Printf("s3cache.Get failed: %s", err)
+		size = -1
+	}
+	if c.compression(h) != compressionNone {
+		size = -1
+		if body, err = c.decompress(body, h); err != nil {
+			return nil, nil, -1, err
 		}
 	}
-	return resp, err == nil
+	if sum := h.Get(checksumHeader); c.VerifyDownloads && sum != "" {
+		body = newVerifyingReader(body, sum)
+	}
+	return body, meta, size, nil
+}
+
+// readAll reads r until EOF, like ioutil.ReadAll, but if size is known, it
+// reads into a buffer of that size rather than growing one as it reads.
+func readAll(r io.Reader, size int64) ([]byte, error) {
+	if size < 0 {
+		return ioutil.ReadAll(r)
+	}
+	// Leave room for ReadFrom to detect EOF without growing the buffer.
+	buf := bytes.NewBuffer(make([]byte, 0, size+bytes.MinRead))
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// gzipReader is a gzip.Reader that also closes the underlying body when it
+// is closed.
+type gzipReader struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (r *gzipReader) Close() error {
+	err := r.Reader.Close()
+	if cerr := r.body.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (c *Cache) Set(key string, resp []byte) {
-	w, err := s3util.Create(c.url(key), nil, &c.Config)
-	if err != nil {
+	c.SetContext(context.Background(), key, resp)
+}
+
+// SetContext is like Set, but the S3 upload is aborted if ctx is cancelled
+// or its deadline passes.
+func (c *Cache) SetContext(ctx context.Context, key string, resp []byte) {
+	if _, err := c.setContext(ctx, key, resp, nil); err != nil && !skipped(err) {
 		if !noLogErrors {
-			log.Printf("s3util.Create failed: %s", err)
+			log.Printf("s3cache.Set failed: %s", err)
 		}
-		return
 	}
-	defer w.Close()
-	if c.Gzip {
-		w = gzip.NewWriter(w)
-		defer w.Close()
+}
+
+// SetWithError is like Set, but it returns any error that occurred while
+// storing the cache entry, annotated as by GetWithError.
+func (c *Cache) SetWithError(key string, resp []byte) error {
+	_, err := c.setContext(context.Background(), key, resp, nil)
+	return c.wrapError("Set", key, err)
+}
+
+// SetWithInfo is like SetWithError, but it also returns the S3 object key
+// under which the cache entry is stored (see ObjectKey), and the
+// number of bytes written to S3, which is the compressed size of the entry
+// if Gzip or Compress is set. If no entry was written, n is zero.
+func (c *Cache) SetWithInfo(key string, resp []byte) (objectKey string, n int, err error) {
+	n, err = c.setContext(context.Background(), key, resp, nil)
+	return c.ObjectKey(key), n, c.wrapError("Set", key, err)
+}
+
+// SetWithOptions is like SetWithError, but it stores the cache entry with
+// the given per-call options, which override the Cache's defaults. With
+// Dedup, they apply to the entry's blob only if it is not already stored.
+func (c *Cache) SetWithOptions(key string, resp []byte, opts SetOptions) error {
+	_, err := c.setContext(context.Background(), key, resp, &opts)
+	return c.wrapError("Set", key, err)
+}
+
+func (c *Cache) setContext(ctx context.Context, key string, resp []byte, opts *SetOptions) (n int, err error) {
+	ctx, endSpan := c.startSpan(ctx, "Set", key)
+	ctx, cancel := c.withTimeout(ctx, "Set")
+	defer cancel()
+	defer func() { endSpan(spanResult(len(resp), true, err)) }()
+	if c.tooLarge(int64(len(resp))) {
+		c.onSkip("Set", key, ErrTooLarge)
+		return 0, ErrTooLarge
+	}
+	if c.ShouldCache != nil && !c.ShouldCache(key, resp) {
+		c.onSkip("Set", key, ErrNotCacheable)
+		return 0, ErrNotCacheable
+	}
+	if c.FallbackCache != nil && c.WriteFallback && !c.ReadOnly {
+		c.FallbackCache.Set(key, resp)
+	}
+	return c.coalesceWrite(ctx, c.ObjectKey(key), func() (n int, err error) {
+		ctx := context.WithValue(ctx, uploadedInParts{}, new(bool))
+		err = c.retry(ctx, "Set", key, func() (err error) {
+			n, err = c.set(ctx, key, resp, opts)
+			return err
+		})
+		c.setDone(key, err)
+		return n, err
+	})
+}
+
+func (c *Cache) set(ctx context.Context, key string, resp []byte, opts *SetOptions) (int, error) {
+	return c.put(ctx, key, c.ObjectKey(key), resp, opts)
+}
+
+// put stores resp as the cache entry for key in the object with the given
+// key, with the per-call options opts, if any, and returns the number of
+// bytes written. The cache key may be empty if it is not known.
+func (c *Cache) put(ctx context.Context, key, objectKey string, resp []byte, opts *SetOptions) (int, error) {
+	if c.Dedup {
+		return c.putDedup(ctx, key, objectKey, resp, opts)
+	}
+	return c.putObject(ctx, key, objectKey, resp, opts)
+}
+
+// putObject is like put, but it stores resp in the object itself even if
+// Dedup is set.
+func (c *Cache) putObject(ctx context.Context, key, objectKey string, resp []byte, opts *SetOptions) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	h := c.uploadHeader()
+	c.setProvenance(h, key)
+	h.Set(checksumHeader, checksum(resp))
+	rh := responseHeader(resp)
+	if ct := rh.Get("Content-Type"); ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	c.setFreshness(h, rh)
+	setEncoding(h, rh)
+	opts.apply(h)
+	codec := compressionNone
+	switch n := headerBlockLen(resp); {
+	case c.CompressBody && !c.Gzip && n >= 0 && c.worthCompressing(resp):
+		h.Del("Content-Encoding")
+		buf := new(bytes.Buffer)
+		if err := gzipBody(buf, resp, n); err != nil {
+			return 0, err
+		}
+		if c.CompressMinSize <= 0 || buf.Len() < len(resp) {
+			h.Set(gzipBodyHeader, strconv.Itoa(n))
+			resp = buf.Bytes()
+			codec = compressionGzip
+		}
+	case c.Gzip || c.Compress && c.worthCompressing(resp):
+		buf := new(bytes.Buffer)
+		gw := getGzipWriter(buf)
+		_, err := gw.Write(resp)
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+		putGzipWriter(gw)
+		if err != nil {
+			return 0, err
+		}
+		if c.Gzip || c.CompressMinSize <= 0 || buf.Len() < len(resp) {
+			resp = buf.Bytes()
+			codec = compressionGzip
+		} else {
+			h.Del("Content-Encoding")
+		}
+	case c.Compress:
+		h.Del("Content-Encoding")
+	}
+	h.Set(compressionHeader, codec)
+	if c.VerifyUploads || c.objectLocked() {
+		sum := md5.Sum(resp)
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
 	}
-	_, err = w.Write(resp)
+	if err := c.setS3Checksum(h, resp); err != nil {
+		return 0, err
+	}
+	err := c.store().Put(ctx, objectKey, bytes.NewReader(resp), int64(len(resp)), h)
 	if err != nil {
-		if !noLogErrors {
-			log.Printf("s3cache.Set failed: %s", err)
+		return 0, c.ignoreExisting(err)
+	}
+	c.recordWrite(objectKey, resp)
+	return len(resp), nil
+}
+
+// ignoreExisting returns nil if err reports that a conditional write was
+// rejected because the object already exists and SkipIfExists is set, and
+// err otherwise.
+func (c *Cache) ignoreExisting(err error) error {
+	if e, ok := err.(*StatusError); ok && c.SkipIfExists && e.StatusCode == http.StatusPreconditionFailed {
+		return nil
+	}
+	return err
+}
+
+// SetReader is like SetWithError, but it streams the cache entry from r
+// instead of requiring it to be in memory. Since the size of the entry is
+// not known in advance, it is uploaded to S3 in parts.
+func (c *Cache) SetReader(key string, r io.Reader) error {
+	if err := c.permit("Set"); err != nil {
+		c.onSkip("Set", key, err)
+		return c.wrapError("Set", key, err)
+	}
+	if c.MaxObjectSize > 0 {
+		r = &maxSizeReader{r: r, n: c.MaxObjectSize}
+	}
+	err := c.setReader(context.Background(), key, r)
+	c.setDone(key, err)
+	return c.wrapError("Set", key, err)
+}
+
+// SetReaderSize is like SetReader, but the cache entry is known to be size
+// bytes long. Unless the entry is compressed, it is uploaded in a single
+// request with a Content-Length of size.
+func (c *Cache) SetReaderSize(key string, r io.Reader, size int64) error {
+	if err := c.permit("Set"); err != nil {
+		c.onSkip("Set", key, err)
+		return c.wrapError("Set", key, err)
+	}
+	if c.tooLarge(size) {
+		c.onSkip("Set", key, ErrTooLarge)
+		return c.wrapError("Set", key, ErrTooLarge)
+	}
+	if c.Gzip || c.Compress {
+		return c.SetReader(key, r)
+	}
+	h := c.uploadHeader()
+	c.setProvenance(h, key)
+	h.Set(compressionHeader, compressionNone)
+	err := c.store().Put(context.Background(), c.ObjectKey(key), r, size, h)
+	err = c.ignoreExisting(err)
+	c.setDone(key, err)
+	return c.wrapError("Set", key, err)
+}
+
+// setDone records that the cache entry for key was stored, if err is nil,
+// in the miss cache and the index, and reports the outcome to the Cache's
+// callbacks.
+func (c *Cache) setDone(key string, err error) {
+	if err == nil {
+		c.forgetMiss(c.ObjectKey(key))
+		c.addToIndex(key)
+	}
+	c.reportSet(key, err)
+}
+
+// reportSet reports the outcome of storing the cache entry for key to the
+// OnSkip or OnError callback.
+func (c *Cache) reportSet(key string, err error) {
+	switch {
+	case skipped(err):
+		c.onSkip("Set", key, err)
+	case err != nil:
+		c.onError("Set", key, err)
+	}
+}
+
+func (c *Cache) setReader(ctx context.Context, key string, r io.Reader) error {
+	h := c.uploadHeader()
+	c.setProvenance(h, key)
+	h.Set(compressionHeader, compressionNone)
+	if c.Gzip || c.Compress {
+		h.Set(compressionHeader, compressionGzip)
+		pr, pw := io.Pipe()
+		go func() {
+			gw := getGzipWriter(pw)
+			_, err := io.Copy(gw, r)
+			if cerr := gw.Close(); err == nil {
+				err = cerr
+			}
+			putGzipWriter(gw)
+			pw.CloseWithError(err)
+		}()
+		r = pr
+		defer pr.Close()
+	}
+	return c.ignoreExisting(c.store().Put(ctx, c.ObjectKey(key), r, -1, h))
+}
+
+// uploadHeader returns the header with which cache entries are created in
+// S3.
+func (c *Cache) uploadHeader() http.Header {
+	h := make(http.Header)
+	if c.Compress {
+		h.Set("Content-Encoding", "gzip")
+	}
+	if c.DefaultContentType != "" {
+		h.Set("Content-Type", c.DefaultContentType)
+	}
+	if c.ServerSideEncryption != "" {
+		h.Set("X-Amz-Server-Side-Encryption", c.ServerSideEncryption)
+		if c.ServerSideEncryption == "aws:kms" && c.SSEKMSKeyID != "" {
+			h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.SSEKMSKeyID)
+		}
+		if c.ServerSideEncryption == "aws:kms" && len(c.SSEKMSEncryptionContext) > 0 {
+			// JSON object keys are sorted, so the header is deterministic.
+			b, _ := json.Marshal(c.SSEKMSEncryptionContext)
+			h.Set("X-Amz-Server-Side-Encryption-Context", base64.StdEncoding.EncodeToString(b))
+		}
+	}
+	if c.StorageClass != "" {
+		h.Set("X-Amz-Storage-Class", c.StorageClass)
+	}
+	if c.ACL != "" {
+		h.Set("X-Amz-Acl", c.ACL)
+	}
+	if c.SkipIfExists {
+		h.Set("If-None-Match", "*")
+	}
+	for name, value := range c.Metadata {
+		h.Set("X-Amz-Meta-"+name, value)
+	}
+	if len(c.Tags) > 0 {
+		tags := make(url.Values, len(c.Tags))
+		for k, v := range c.Tags {
+			tags.Set(k, v)
 		}
+		h.Set("X-Amz-Tagging", tags.Encode())
 	}
+	c.setObjectLock(h)
+	if c.TTL > 0 {
+		now := c.now().UTC()
+		h.Set(cachedAtHeader, now.Format(time.RFC3339Nano))
+		h.Set("Expires", now.Add(c.TTL).Format(http.TimeFormat))
+	}
+	return h
 }
 
-func (c *Cache) Delete(key string) {
-	rdr, err := s3util.Delete(c.url(key), &c.Config)
+// responseHeader returns the header of resp if it is a serialized HTTP
+// response, and nil otherwise.
+func responseHeader(resp []byte) http.Header {
+	if !bytes.HasPrefix(resp, []byte("HTTP/")) {
+		return nil
+	}
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
 	if err != nil {
+		return nil
+	}
+	r.Body.Close()
+	return r.Header
+}
+
+func (c *Cache) Delete(key string) {
+	c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but the S3 request is aborted if ctx is
+// cancelled or its deadline passes.
+func (c *Cache) DeleteContext(ctx context.Context, key string) {
+	if err := c.deleteContext(ctx, key); err != nil && !skipped(err) {
 		if !noLogErrors {
 			log.Printf("s3cache.Delete failed: %s", err)
 		}
-		return
 	}
-	defer rdr.Close()
 }
 
-func (c *Cache) url(key string) string {
-	key = cacheKeyToObjectKey(key)
+// DeleteWithError is like Delete, but it returns any error that occurred
+// while deleting the cache entry, annotated as by GetWithError. Deleting an
+// entry that does not exist is not an error.
+func (c *Cache) DeleteWithError(key string) error {
+	return c.wrapError("Delete", key, c.deleteContext(context.Background(), key))
+}
+
+func (c *Cache) deleteContext(ctx context.Context, key string) (err error) {
+	ctx, endSpan := c.startSpan(ctx, "Delete", key)
+	ctx, cancel := c.withTimeout(ctx, "Delete")
+	defer cancel()
+	defer func() { endSpan(spanResult(0, true, err)) }()
+	c.forgetEntry(key)
+	err = c.retry(ctx, "Delete", key, func() error {
+		return c.delete(ctx, key)
+	})
+	switch {
+	case skipped(err):
+		c.onSkip("Delete", key, err)
+	case err != nil:
+		c.onError("Delete", key, err)
+	}
+	return err
+}
+
+// forgetEntry forgets what c remembers about the cache entry for key, which
+// is being deleted: its recent write and its copy in FallbackCache. A
+// recorded miss is kept, since the entry will still be missing.
+func (c *Cache) forgetEntry(key string) {
+	if c.FallbackCache != nil && !c.ReadOnly {
+		c.FallbackCache.Delete(key)
+	}
+	c.forgetWrite(c.ObjectKey(key))
+}
+
+func (c *Cache) delete(ctx context.Context, key string) error {
+	err := c.store().Delete(ctx, c.ObjectKey(key))
+	if errors.Is(err, ErrNotFound) {
+		// The entry is already gone.
+		return nil
+	}
+	return c.lockedError(err)
+}
+
+// Exists reports whether a cache entry exists for key. Unlike Get, it issues
+// a HEAD request and does not download the entry.
+func (c *Cache) Exists(key string) (bool, error) {
+	h, err := c.store().Head(context.Background(), c.ObjectKey(key))
+	if err != nil {
+		return false, c.wrapError("Head", key, err)
+	}
+	return h != nil, nil
+}
+
+// Stat returns the size and modification time of the cache entry for key,
+// as reported by a HEAD request, without downloading the entry. The size is
+// that of the stored object, which is compressed if Gzip or Compress was set
+// when the entry was stored. If no entry exists, ok is false and err is nil.
+func (c *Cache) Stat(key string) (size int64, modTime time.Time, ok bool, err error) {
+	size, modTime, ok, err = c.stat(key)
+	return size, modTime, ok, c.wrapError("Head", key, err)
+}
+
+func (c *Cache) stat(key string) (size int64, modTime time.Time, ok bool, err error) {
+	h, err := c.store().Head(context.Background(), c.ObjectKey(key))
+	if err != nil || h == nil {
+		return 0, time.Time{}, false, err
+	}
+	if sum := h.Get(blobHeader); sum != "" {
+		modTime, _ := http.ParseTime(h.Get("Last-Modified"))
+		if h, err = c.store().Head(context.Background(), c.blobKey(sum)); err != nil || h == nil {
+			return 0, time.Time{}, false, err
+		}
+		h = cloneHeader(h)
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, time.Time{}, false, fmt.Errorf("s3cache: invalid Content-Length %q", v)
+		}
+	}
+	if v := h.Get("Last-Modified"); v != "" {
+		if modTime, err = http.ParseTime(v); err != nil {
+			return 0, time.Time{}, false, fmt.Errorf("s3cache: invalid Last-Modified %q", v)
+		}
+	}
+	return size, modTime, true, nil
+}
+
+// Ping checks that S3 is reachable and accepts the Cache's credentials, by
+// listing objects under a prefix that holds no cache entries. It has no
+// side effects. It requires permission to list the bucket.
+func (c *Cache) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but the S3 request is aborted if ctx is
+// cancelled or its deadline passes.
+func (c *Cache) PingContext(ctx context.Context) error {
+	ctx, cancel := c.withTimeout(ctx, "Get")
+	defer cancel()
+	_, err := c.keys(ctx)
+	if err != nil {
+		return err
+	}
+	return c.store().List(ctx, c.keyPrefix()+".s3cache-ping/", func([]ObjectInfo) error { return nil })
+}
+
+// Close flushes any pending index entries, without scheduling another flush
+// if that fails, and releases the resources held by the cache: the idle connections of its HTTP client, and its Store and
+// Credentials if they implement io.Closer. Operations may still be
+// performed after Close, but will open new connections. Close is idempotent
+// if Store's and Credentials' Close methods are.
+func (c *Cache) Close() error {
+	err := c.closeIndex()
+	c.client().CloseIdleConnections()
+	for _, v := range []interface{}{c.Store, c.Credentials} {
+		if closer, ok := v.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+var _ io.Closer = (*Cache)(nil)
+
+// url returns the URL of the object of the cache entry for key.
+func (c *Cache) url(key string) (*url.URL, error) {
+	return c.objectURL(c.ObjectKey(key), "")
+}
+
+// ObjectKey returns the S3 object key, relative to the bucket, under which
+// the cache entry for key is stored. If Normalize is set, key is first
+// replaced by Normalize(key). The object key is the concatenation of:
+//
+//   - Prefix, followed by a slash, if Prefix is set;
+//   - KeyVersion, followed by a slash, if KeyVersion is set;
+//   - ShardLevels directories named by successive pairs of hex digits of the
+//     MD5 hash of key (e.g., "ab/cd/"), if ShardLevels is positive;
+//   - KeyFunc(key) if KeyFunc is set, key percent-encoded if ReadableKeys
+//     is set (see ReadableKeys), and otherwise the hex-encoded MD5 hash of
+//     key;
+//   - KeySuffix;
+//   - ".gz", if Gzip is set.
+//
+// This mapping is stable, so that tools can locate the objects of cache
+// entries in S3.
+func (c *Cache) ObjectKey(key string) string {
+	if c.Normalize != nil {
+		key = c.Normalize(key)
+	}
+	hash := cacheKeyToObjectKey(key)
+	dir := c.keyPrefix() + shardPath(hash, c.ShardLevels)
+	suffix := c.KeySuffix
 	if c.Gzip {
-		key += ".gz"
+		suffix += ".gz"
 	}
-	if strings.HasSuffix(c.BucketURL, "/") {
-		return c.BucketURL + key
+	switch {
+	case c.KeyFunc != nil:
+		key = c.KeyFunc(key)
+	case c.ReadableKeys && key != "":
+		key = readableKey(key)
+		if len(dir)+len(key)+len(suffix) > maxObjectKeyLen {
+			key = hash
+		}
+	default:
+		key = hash
 	}
-	return c.BucketURL + "/" + key
+	return dir + key + suffix
+}
+
+// maxObjectKeyLen is the maximum length in bytes of an S3 object key.
+const maxObjectKeyLen = 1024
+
+// readableKey returns the cache key percent-encoded for use in an object
+// key when ReadableKeys is set.
+func readableKey(key string) string {
+	key = uriEncode(key, true)
+	if key == "." || key == ".." {
+		// Path segments that HTTP clients and S3 may resolve away.
+		key = strings.Replace(key, ".", "%2E", -1)
+	}
+	return key
+}
+
+// shardPath returns the sharding subdirectories for an object whose cache
+// key has the given hex-encoded hash, e.g. "ab/cd/" for 2 levels.
+func shardPath(hash string, levels int) string {
+	if levels > len(hash)/2 {
+		levels = len(hash) / 2
+	}
+	var path []byte
+	for i := 0; i < levels; i++ {
+		path = append(path, hash[2*i:2*i+2]...)
+		path = append(path, '/')
+	}
+	return string(path)
+}
+
+// keyPrefix returns the prefix shared by the object keys of all cache
+// entries: Prefix and KeyVersion, each followed by a single slash if it is
+// set.
+func (c *Cache) keyPrefix() string {
+	var prefix string
+	for _, dir := range []string{c.Prefix, c.KeyVersion} {
+		if dir = strings.Trim(dir, "/"); dir != "" {
+			prefix += dir + "/"
+		}
+	}
+	return prefix
 }
 
 func cacheKeyToObjectKey(key string) string {
@@ -125,3 +1454,86 @@ func New(bucketURL string) *Cache {
 		BucketURL: bucketURL,
 	}
 }
+
+// NewForBucket is like New, but it constructs the bucket URL from the name
+// of the bucket and its AWS region (e.g., "us-west-2"). If region is empty,
+// the AWS_REGION environment variable is used, and if that is unset, the
+// bucket is assumed to be in us-east-1.
+func NewForBucket(bucket, region string) *Cache {
+	c := New(bucketURLForRegion(bucket, region))
+	c.Region = region
+	// The Signature Version 2 signer cannot derive the bucket name from a
+	// dotted regional endpoint's host, so have it take the bucket name from
+	// the path.
+	c.PathStyle = true
+	return c
+}
+
+// NewAnonymous returns a new read-only Cache for a public bucket, which
+// does not sign its requests. See Anonymous.
+func NewAnonymous(bucketURL string) *Cache {
+	return &Cache{
+		Config:    s3util.Config{Service: s3.DefaultService},
+		BucketURL: bucketURL,
+		Anonymous: true,
+	}
+}
+
+// bucketURLForRegion returns the path-style URL of the Amazon S3 bucket in
+// the given region.
+func bucketURLForRegion(bucket, region string) string {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" || region == "us-east-1" {
+		return "https://s3.amazonaws.com/" + bucket
+	}
+	return "https://s3." + region + ".amazonaws.com/" + bucket
+}
+
+// NewValidated is like New, but it returns an error if bucketURL is not an
+// absolute HTTP or HTTPS URL, or if it is a path-style Amazon S3 URL that
+// does not name a bucket (e.g., "https://s3-us-west-2.amazonaws.com").
+func NewValidated(bucketURL string) (*Cache, error) {
+	if err := validateBucketURL(bucketURL); err != nil {
+		return nil, err
+	}
+	return New(bucketURL), nil
+}
+
+func validateBucketURL(bucketURL string) error {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return fmt.Errorf("s3cache: invalid bucket URL %q: %s", bucketURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("s3cache: bucket URL %q must have an http or https scheme", bucketURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("s3cache: bucket URL %q has no host", bucketURL)
+	}
+	if isPathStyleAmazonHost(u.Hostname()) && strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("s3cache: bucket URL %q has no bucket name in its path", bucketURL)
+	}
+	return nil
+}
+
+// isPathStyleAmazonHost reports whether host is an Amazon S3 endpoint that
+// does not include a bucket name, such as "s3.us-west-2.amazonaws.com", as
+// opposed to a virtual-hosted-style endpoint such as
+// "mybucket.s3.us-west-2.amazonaws.com".
+func isPathStyleAmazonHost(host string) bool {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".amazonaws.com") {
+		return false
+	}
+	// The bucket name may itself look like an endpoint label (e.g.
+	// "s3-data.s3.amazonaws.com"), so look for the last such label.
+	labels := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if labels[i] == "s3" || strings.HasPrefix(labels[i], "s3-") {
+			return i == 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,422 @@
+package s3cache_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// getters are the methods that get a cache entry, adapted to the signature
+// of GetWithError.
+var getters = map[string]func(c *s3cache.Cache, key string) ([]byte, bool, error){
+	"GetWithError": (*s3cache.Cache).GetWithError,
+	"GetDecoded":   (*s3cache.Cache).GetDecoded,
+	"GetWithMeta": func(c *s3cache.Cache, key string) ([]byte, bool, error) {
+		resp, _, ok, err := c.GetWithMeta(key)
+		return resp, ok, err
+	},
+	"GetReader": func(c *s3cache.Cache, key string) ([]byte, bool, error) {
+		r, ok, err := c.GetReader(key)
+		if !ok {
+			return nil, ok, err
+		}
+		defer r.Close()
+		resp, err := ioutil.ReadAll(r)
+		return resp, ok, err
+	},
+}
+
+// TestGetters checks that each of the getters consults the read replicas,
+// the fallback cache and the miss cache, and reports its outcome.
+func TestGetters(t *testing.T) {
+	for name, get := range getters {
+		t.Run(name, func(t *testing.T) {
+			st := memstore.New()
+			replica := &s3cache.Cache{Store: memstore.New()}
+			replica.Set("replicated", []byte("from replica"))
+			fallback := &s3cache.Cache{Store: memstore.New()}
+			fallback.Set("fallen back", []byte("from fallback"))
+			var completed int
+			c := &s3cache.Cache{
+				Store:            st,
+				ReadReplicas:     []*s3cache.Cache{replica},
+				FallbackCache:    fallback,
+				NegativeCacheTTL: time.Minute,
+				OnComplete: func(op string, _ int, _ time.Duration, _ error) {
+					if op == "Get" {
+						completed++
+					}
+				},
+			}
+			c.Set("k", []byte("v"))
+
+			if resp, ok, err := get(c, "k"); err != nil || !ok || string(resp) != "v" {
+				t.Errorf("got %q, %v, %v; want the entry", resp, ok, err)
+			}
+			st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 500})
+			if resp, ok, _ := get(c, "replicated"); !ok || string(resp) != "from replica" {
+				t.Errorf("with the primary down, got %q, %v; want the replica's entry", resp, ok)
+			}
+			st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 500})
+			if resp, ok, _ := get(c, "fallen back"); !ok || string(resp) != "from fallback" {
+				t.Errorf("with S3 down, got %q, %v; want the fallback's entry", resp, ok)
+			}
+
+			if _, ok, err := get(c, "missing"); ok || err != nil {
+				t.Fatalf("got %v, %v; want a miss", ok, err)
+			}
+			// The miss is remembered, so a concurrent write by another
+			// process is not seen until NegativeCacheTTL passes.
+			(&s3cache.Cache{Store: st}).Set("missing", []byte("v"))
+			if _, ok, _ := get(c, "missing"); ok {
+				t.Error("recent miss was not remembered")
+			}
+			if completed != 5 {
+				t.Errorf("OnComplete called %d times, want 5", completed)
+			}
+		})
+	}
+}
+
+func TestFallbackCache(t *testing.T) {
+	st := memstore.New()
+	fallback := &s3cache.Cache{Store: memstore.New()}
+	c := &s3cache.Cache{Store: st, FallbackCache: fallback}
+	fallback.Set("k", []byte("from fallback"))
+
+	// The fallback is not consulted for a clean miss.
+	if resp, ok := c.Get("k"); ok {
+		t.Errorf("for a miss in S3, got %q from the fallback", resp)
+	}
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 503})
+	if resp, ok := c.Get("k"); !ok || string(resp) != "from fallback" {
+		t.Errorf("with S3 down, got %q, %v; want the fallback's entry", resp, ok)
+	}
+
+	c.Set("a", []byte("v"))
+	if _, ok := fallback.Get("a"); ok {
+		t.Error("Set wrote to the fallback without WriteFallback")
+	}
+	c.WriteFallback = true
+	c.Set("b", []byte("v"))
+	st.Fail("Put", 1, &s3cache.StatusError{StatusCode: 503})
+	c.Set("c", []byte("v"))
+	for _, key := range []string{"b", "c"} {
+		if resp, ok := fallback.Get(key); !ok || string(resp) != "v" {
+			t.Errorf("with WriteFallback, the fallback has %q, %v for %s", resp, ok, key)
+		}
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Error("with WriteFallback, Set did not write to S3")
+	}
+	c.Delete("b")
+	if _, ok := fallback.Get("b"); ok {
+		t.Error("Delete did not delete the fallback's entry")
+	}
+}
+
+func TestReadReplicas(t *testing.T) {
+	st, st1, st2 := memstore.New(), memstore.New(), memstore.New()
+	r1, r2 := &s3cache.Cache{Store: st1}, &s3cache.Cache{Store: st2}
+	c := &s3cache.Cache{Store: st, ReadReplicas: []*s3cache.Cache{r1, r2}}
+	c.Set("k", []byte("primary"))
+	r1.Set("k", []byte("replica 1"))
+	r2.Set("k", []byte("replica 2"))
+	r2.Set("only in replica 2", []byte("replica 2"))
+
+	if resp, ok := c.Get("k"); !ok || string(resp) != "primary" {
+		t.Errorf("got %q, %v; want the primary's entry", resp, ok)
+	}
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 503})
+	if resp, ok := c.Get("k"); !ok || string(resp) != "replica 1" {
+		t.Errorf("with the primary down, got %q, %v; want the first replica's entry", resp, ok)
+	}
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 503})
+	st1.Fail("Get", 1, &s3cache.StatusError{StatusCode: 503})
+	if resp, ok := c.Get("k"); !ok || string(resp) != "replica 2" {
+		t.Errorf("with the primary and first replica down, got %q, %v; want the second replica's entry", resp, ok)
+	}
+	if resp, ok := c.Get("only in replica 2"); !ok || string(resp) != "replica 2" {
+		t.Errorf("for a miss in the primary, got %q, %v; want the replica's entry", resp, ok)
+	}
+
+	// Writes go only to the primary.
+	c.Set("new", []byte("v"))
+	c.Delete("k")
+	if st1.Len() != 1 || st2.Len() != 2 {
+		t.Errorf("replicas hold %d and %d objects after writes to the primary, want 1 and 2", st1.Len(), st2.Len())
+	}
+	if resp, ok := r1.Get("k"); !ok || string(resp) != "replica 1" {
+		t.Errorf("Delete removed the replica's entry: got %q, %v", resp, ok)
+	}
+}
+
+func TestShouldCache(t *testing.T) {
+	st := memstore.New()
+	fallback := &s3cache.Cache{Store: memstore.New()}
+	var skipped []string
+	c := &s3cache.Cache{
+		Store:         st,
+		FallbackCache: fallback,
+		WriteFallback: true,
+		ShouldCache: func(key string, resp []byte) bool {
+			return !bytes.Contains(resp, []byte("\r\nSet-Cookie:"))
+		},
+		OnSkip: func(op, key string, reason error) {
+			if op != "Set" || !errors.Is(reason, s3cache.ErrNotCacheable) {
+				t.Errorf("OnSkip(%q, %q, %v)", op, key, reason)
+			}
+			skipped = append(skipped, key)
+		},
+		OnError: func(op, key string, err error) { t.Errorf("OnError(%q, %q, %v)", op, key, err) },
+	}
+	private := []byte("HTTP/1.1 200 OK\r\nSet-Cookie: session=secret\r\n\r\n")
+	public := []byte("HTTP/1.1 200 OK\r\nCache-Control: public\r\n\r\n")
+
+	if err := c.SetWithError("private", private); !errors.Is(err, s3cache.ErrNotCacheable) {
+		t.Errorf("SetWithError = %v, want ErrNotCacheable", err)
+	}
+	c.Set("private", private)
+	c.Set("public", public)
+	if len(skipped) != 2 || skipped[0] != "private" || skipped[1] != "private" {
+		t.Errorf("OnSkip called for %q, want twice for private", skipped)
+	}
+	if resp, ok := c.Get("private"); ok {
+		t.Errorf("Get returned %q for a skipped entry", resp)
+	}
+	if _, ok := fallback.Get("private"); ok {
+		t.Error("a skipped entry was written to the fallback")
+	}
+	if st.Len() != 1 {
+		t.Errorf("store holds %d objects, want only the public entry", st.Len())
+	}
+	if resp, ok := c.Get("public"); !ok || !bytes.Equal(resp, public) {
+		t.Errorf("got %q, %v for an entry that should be cached", resp, ok)
+	}
+}
+
+// TestEmptyEntry checks that an empty entry is returned as a non-nil empty
+// slice, and is distinguished from a miss.
+func TestEmptyEntry(t *testing.T) {
+	_, s3 := newFakeS3(t)
+	caches := map[string]s3cache.HTTPCache{
+		"memstore": &s3cache.Cache{Store: memstore.New()},
+		"Compress": &s3cache.Cache{Store: memstore.New(), Compress: true},
+		"Gzip":     &s3cache.Cache{Store: memstore.New(), Gzip: true},
+		"S3":       s3,
+		"tiered":   s3cache.NewTiered(&s3cache.Cache{Store: memstore.New()}, 10, 0),
+		"sharded":  s3cache.NewSharded(&s3cache.Cache{Store: memstore.New()}),
+	}
+	for name, c := range caches {
+		c.Set("empty", []byte{})
+		c.Set("nil", nil)
+		// Read twice, so that the tiered cache serves memory hits too.
+		for i := 0; i < 2; i++ {
+			for _, key := range []string{"empty", "nil"} {
+				if resp, ok := c.Get(key); !ok || resp == nil || len(resp) != 0 {
+					t.Errorf("%s: Get(%q) = %#v, %v; want []byte{}, true", name, key, resp, ok)
+				}
+			}
+			if resp, ok := c.Get("missing"); ok || resp != nil {
+				t.Errorf("%s: Get of a missing key = %#v, %v; want nil, false", name, resp, ok)
+			}
+		}
+	}
+	for name, get := range getters {
+		c := &s3cache.Cache{Store: memstore.New()}
+		c.Set("empty", []byte{})
+		if resp, ok, err := get(c, "empty"); !ok || resp == nil || len(resp) != 0 || err != nil {
+			t.Errorf("%s: got %#v, %v, %v; want []byte{}, true", name, resp, ok, err)
+		}
+		if resp, ok, err := get(c, "missing"); ok || resp != nil || err != nil {
+			t.Errorf("%s: for a missing key, got %#v, %v, %v; want nil, false", name, resp, ok, err)
+		}
+	}
+}
+
+// httpResponse returns a serialized HTTP response, as httpcache stores
+// them, with the given body.
+func httpResponse(t *testing.T, body []byte) []byte {
+	r := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}, "Etag": {`"abc"`}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestRoundTrip checks that entries, including binary HTTP responses, are
+// stored and returned byte for byte.
+func TestRoundTrip(t *testing.T) {
+	binary := make([]byte, 256*64)
+	for i := range binary {
+		binary[i] = byte(i) // includes NULs, CR, LF and high bytes
+	}
+	entries := map[string][]byte{
+		"empty":           {},
+		"binary":          binary,
+		"binary response": httpResponse(t, binary),
+		// Larger than the 5 MB that s3util buffers before uploading.
+		"large response": httpResponse(t, bytes.Repeat(binary, 6<<20/len(binary)+1)),
+		"chunked":        []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\n\x00\xff\n\r\n0\r\n\r\n"),
+	}
+	for _, opts := range []struct {
+		name string
+		set  func(*s3cache.Cache)
+	}{
+		{"plain", func(*s3cache.Cache) {}},
+		{"Compress", func(c *s3cache.Cache) { c.Compress = true }},
+		{"CompressBody", func(c *s3cache.Cache) { c.CompressBody = true }},
+		{"Gzip", func(c *s3cache.Cache) { c.Gzip = true }},
+		{"Dedup", func(c *s3cache.Cache) { c.Dedup = true }},
+	} {
+		t.Run(opts.name, func(t *testing.T) {
+			c := &s3cache.Cache{Store: memstore.New()}
+			opts.set(c)
+			for key, resp := range entries {
+				c.Set(key, resp)
+				got, ok := c.Get(key)
+				if !ok || !bytes.Equal(got, resp) {
+					t.Errorf("%s: Get returned %d bytes, %v; want the %d stored", key, len(got), ok, len(resp))
+				}
+				c.Delete(key)
+				if got, ok := c.Get(key); ok {
+					t.Errorf("%s: after Delete, Get returned %d bytes", key, len(got))
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentUse runs many concurrent operations on a single Cache,
+// so that the race detector can check that it is safe to share.
+func TestConcurrentUse(t *testing.T) {
+	_, s3 := newFakeS3(t)
+	for name, c := range map[string]*s3cache.Cache{
+		"memstore": {
+			Store:            memstore.New(),
+			Compress:         true,
+			NegativeCacheTTL: time.Millisecond,
+			MaxConcurrency:   8,
+		},
+		"S3": s3,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 300; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					key := "k" + strconv.Itoa(i%10)
+					switch i % 3 {
+					case 0:
+						c.Set(key, []byte(key))
+					case 1:
+						if resp, ok := c.Get(key); ok && string(resp) != key {
+							t.Errorf("Get(%q) = %q", key, resp)
+						}
+					case 2:
+						c.Delete(key)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// benchResponse is a 16 KB serialized HTTP response, as httpcache stores.
+var benchResponse = append([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 16380\r\n\r\n"),
+	bytes.Repeat([]byte(`{"hello":"world"}`), 16380/17)...)
+
+func BenchmarkGet(b *testing.B) {
+	c := &s3cache.Cache{Store: memstore.New()}
+	c.Set("k", benchResponse)
+	b.SetBytes(int64(len(benchResponse)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, ok := c.Get("k"); !ok {
+			b.Fatal("miss")
+		}
+	}
+}
+
+// TestReadAll checks that reading an entry into a buffer of its expected
+// size returns the whole entry even if the size is wrong or unknown.
+func TestReadAll(t *testing.T) {
+	resp := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, size := range []int64{-1, 0, 1, int64(len(resp)), int64(len(resp)) + 1, 2 * int64(len(resp))} {
+		got, err := s3cache.ReadAll(bytes.NewReader(resp), size)
+		if err != nil || !bytes.Equal(got, resp) {
+			t.Errorf("size %d: read %d bytes, %v; want %d", size, len(got), err, len(resp))
+		}
+	}
+}
+
+// BenchmarkReadAll compares reading an entry of known size with
+// ioutil.ReadAll, which grows its buffer repeatedly, to reading it into a
+// buffer of that size, as Get does.
+func BenchmarkReadAll(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		resp := bytes.Repeat([]byte("x"), size)
+		b.Run("ioutil.ReadAll/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ioutil.ReadAll(bytes.NewReader(resp)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("presized/"+strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := s3cache.ReadAll(bytes.NewReader(resp), int64(size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	c := &s3cache.Cache{Store: memstore.New()}
+	b.SetBytes(int64(len(benchResponse)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Set("k"+strconv.Itoa(i%100), benchResponse)
+	}
+}
+
+func BenchmarkSetCompress(b *testing.B) {
+	c := &s3cache.Cache{Store: memstore.New(), Compress: true}
+	b.SetBytes(int64(len(benchResponse)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Set("k"+strconv.Itoa(i%100), benchResponse)
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	c := &s3cache.Cache{Store: memstore.New()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Delete("k")
+	}
+}
@@ -0,0 +1,22 @@
+package s3cacheprom_test
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/s3cacheprom"
+)
+
+// This example exports the metrics of a Cache to the default registry.
+func ExampleNewCollector() {
+	c := s3cache.New("https://s3.us-west-2.amazonaws.com/mybucket")
+	prometheus.MustRegister(s3cacheprom.NewCollector(c))
+}
+
+// This example exports the metrics of two Caches to the default registry,
+// distinguished by a "cache" label.
+func ExampleNewCollector_labels() {
+	pages := s3cache.New("https://s3.us-west-2.amazonaws.com/pages")
+	images := s3cache.New("https://s3.us-west-2.amazonaws.com/images")
+	prometheus.WrapRegistererWith(prometheus.Labels{"cache": "pages"}, prometheus.DefaultRegisterer).MustRegister(s3cacheprom.NewCollector(pages))
+	prometheus.WrapRegistererWith(prometheus.Labels{"cache": "images"}, prometheus.DefaultRegisterer).MustRegister(s3cacheprom.NewCollector(images))
+}
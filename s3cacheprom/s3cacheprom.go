@@ -0,0 +1,126 @@
+// Package s3cacheprom exports the metrics of an s3cache.Cache to Prometheus.
+//
+// To export the metrics of a Cache to the default registry:
+//
+//	c := s3cache.New(bucketURL)
+//	prometheus.MustRegister(s3cacheprom.NewCollector(c))
+//
+// The metrics of several Caches can be registered with distinct labels
+// using prometheus.WrapRegistererWith.
+package s3cacheprom // import "sourcegraph.com/sourcegraph/s3cache/s3cacheprom"
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sourcegraph.com/sourcegraph/s3cache"
+)
+
+// A Collector is a prometheus.Collector of the metrics of a Cache:
+//
+//   - s3cache_hits_total and s3cache_misses_total, the number of cache
+//     hits and misses;
+//   - s3cache_errors_total, the number of failed operations, by "op";
+//   - s3cache_read_bytes_total and s3cache_written_bytes_total, the size of
+//     the cache entries returned by Get and stored by Set;
+//   - s3cache_operation_duration_seconds, a histogram of the duration of
+//     Get, Set and Delete operations, by "op".
+type Collector struct {
+	hits     prometheus.Counter
+	misses   prometheus.Counter
+	errors   *prometheus.CounterVec
+	read     prometheus.Counter
+	written  prometheus.Counter
+	duration *prometheus.HistogramVec
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a Collector of the metrics of c, which it records by
+// setting c's OnHit, OnMiss, OnError and OnComplete callbacks. Callbacks
+// already set on c are still called. NewCollector must be called before c
+// is first used.
+func NewCollector(c *s3cache.Cache) *Collector {
+	m := &Collector{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3cache_hits_total",
+			Help: "Number of cache hits.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3cache_misses_total",
+			Help: "Number of cache misses.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3cache_errors_total",
+			Help: "Number of failed cache operations.",
+		}, []string{"op"}),
+		read: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3cache_read_bytes_total",
+			Help: "Total size of the cache entries read.",
+		}),
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "s3cache_written_bytes_total",
+			Help: "Total size of the cache entries written.",
+		}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "s3cache_operation_duration_seconds",
+			Help:    "Duration of cache operations, including retries.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+	}
+
+	onHit, onMiss, onError, onComplete := c.OnHit, c.OnMiss, c.OnError, c.OnComplete
+	c.OnHit = func(key string) {
+		m.hits.Inc()
+		if onHit != nil {
+			onHit(key)
+		}
+	}
+	c.OnMiss = func(key string) {
+		m.misses.Inc()
+		if onMiss != nil {
+			onMiss(key)
+		}
+	}
+	c.OnError = func(op, key string, err error) {
+		m.errors.WithLabelValues(op).Inc()
+		if onError != nil {
+			onError(op, key, err)
+		}
+	}
+	c.OnComplete = func(op string, bytes int, dur time.Duration, err error) {
+		if err == nil {
+			switch op {
+			case "Get":
+				m.read.Add(float64(bytes))
+			case "Set":
+				m.written.Add(float64(bytes))
+			}
+		}
+		m.duration.WithLabelValues(op).Observe(dur.Seconds())
+		if onComplete != nil {
+			onComplete(op, bytes, dur, err)
+		}
+	}
+	return m
+}
+
+// Describe implements prometheus.Collector.
+func (m *Collector) Describe(ch chan<- *prometheus.Desc) {
+	m.hits.Describe(ch)
+	m.misses.Describe(ch)
+	m.errors.Describe(ch)
+	m.read.Describe(ch)
+	m.written.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Collector) Collect(ch chan<- prometheus.Metric) {
+	m.hits.Collect(ch)
+	m.misses.Collect(ch)
+	m.errors.Collect(ch)
+	m.read.Collect(ch)
+	m.written.Collect(ch)
+	m.duration.Collect(ch)
+}
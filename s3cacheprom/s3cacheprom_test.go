@@ -0,0 +1,58 @@
+package s3cacheprom_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+	"sourcegraph.com/sourcegraph/s3cache/s3cacheprom"
+)
+
+func TestCollector(t *testing.T) {
+	st := memstore.New()
+	var hits int
+	c := &s3cache.Cache{Store: st, OnHit: func(string) { hits++ }}
+	m := s3cacheprom.NewCollector(c)
+	prometheus.NewPedanticRegistry().MustRegister(m)
+
+	c.Set("k", []byte("value"))
+	c.Get("k")
+	c.Get("k")
+	c.Get("missing")
+	st.Fail("Get", 1, &s3cache.StatusError{StatusCode: 500})
+	c.Get("k")
+	st.Fail("Put", 1, &s3cache.StatusError{StatusCode: 500})
+	c.Set("k", []byte("value"))
+
+	want := `
+# HELP s3cache_hits_total Number of cache hits.
+# TYPE s3cache_hits_total counter
+s3cache_hits_total 2
+# HELP s3cache_misses_total Number of cache misses.
+# TYPE s3cache_misses_total counter
+s3cache_misses_total 1
+# HELP s3cache_errors_total Number of failed cache operations.
+# TYPE s3cache_errors_total counter
+s3cache_errors_total{op="Get"} 1
+s3cache_errors_total{op="Set"} 1
+# HELP s3cache_read_bytes_total Total size of the cache entries read.
+# TYPE s3cache_read_bytes_total counter
+s3cache_read_bytes_total 10
+# HELP s3cache_written_bytes_total Total size of the cache entries written.
+# TYPE s3cache_written_bytes_total counter
+s3cache_written_bytes_total 5
+`
+	names := []string{"s3cache_hits_total", "s3cache_misses_total", "s3cache_errors_total", "s3cache_read_bytes_total", "s3cache_written_bytes_total"}
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), names...); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(m, "s3cache_operation_duration_seconds"); n != 2 {
+		t.Errorf("durations recorded for %d operations, want 2 (Get and Set)", n)
+	}
+	if hits != 2 {
+		t.Errorf("the Cache's own OnHit was called %d times, want 2", hits)
+	}
+}
@@ -0,0 +1,49 @@
+package s3cache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+)
+
+// Checksum algorithms for Cache.ChecksumAlgorithm.
+const (
+	ChecksumCRC32C = "CRC32C"
+	ChecksumSHA256 = "SHA256"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// s3Checksum returns the name and value of the header in which S3 accepts
+// the checksum of data computed with the given algorithm.
+func s3Checksum(algorithm string, data []byte) (name, value string, err error) {
+	var sum []byte
+	switch algorithm {
+	case ChecksumCRC32C:
+		sum = binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, castagnoli))
+	case ChecksumSHA256:
+		s := sha256.Sum256(data)
+		sum = s[:]
+	default:
+		return "", "", fmt.Errorf("s3cache: unsupported ChecksumAlgorithm %q", algorithm)
+	}
+	return "X-Amz-Checksum-" + algorithm, base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// setS3Checksum sets the header of a request that uploads data to include
+// its checksum computed with c.ChecksumAlgorithm, if it is set.
+func (c *Cache) setS3Checksum(h http.Header, data []byte) error {
+	if c.ChecksumAlgorithm == "" {
+		return nil
+	}
+	name, value, err := s3Checksum(c.ChecksumAlgorithm, data)
+	if err != nil {
+		return err
+	}
+	h.Set("X-Amz-Sdk-Checksum-Algorithm", c.ChecksumAlgorithm)
+	h.Set(name, value)
+	return nil
+}
@@ -0,0 +1,492 @@
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sqs/s3"
+)
+
+// s3Store is the default Store, which keeps objects in the S3 bucket
+// configured by a Cache's fields.
+type s3Store struct {
+	c *Cache
+}
+
+// Storage classes for Cache.StorageClass.
+const (
+	StorageClassStandard           = "STANDARD"
+	StorageClassStandardIA         = "STANDARD_IA"
+	StorageClassOneZoneIA          = "ONEZONE_IA"
+	StorageClassIntelligentTiering = "INTELLIGENT_TIERING"
+	StorageClassGlacierIR          = "GLACIER_IR"
+	StorageClassReducedRedundancy  = "REDUCED_REDUNDANCY"
+)
+
+// maxDeleteObjects is the maximum number of objects that may be deleted in
+// a single DeleteObjects request.
+const maxDeleteObjects = 1000
+
+func (s s3Store) Get(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, error) {
+	req, err := s.c.newObjectRequest("GET", key, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	// Objects are decompressed according to their recorded codec, so keep
+	// the transport from transparently gunzipping them.
+	req.Header.Set("Accept-Encoding", "identity")
+	s.c.setSSECustomer(req.Header, "X-Amz-")
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		if resp.Uncompressed {
+			// A custom transport decompressed the object regardless.
+			h := cloneHeader(resp.Header)
+			h.Set(compressionHeader, compressionNone)
+			return resp.Body, h, nil
+		}
+		return resp.Body, resp.Header, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil, nil
+	}
+	err = s.statusError(resp)
+	if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusForbidden && strings.Contains(e.Body, "InvalidObjectState") {
+		// The object has been archived, e.g. by Intelligent-Tiering, and
+		// must be restored before it can be read.
+		return nil, nil, nil
+	}
+	return nil, nil, err
+}
+
+func (s s3Store) Head(ctx context.Context, key string) (http.Header, error) {
+	req, err := s.c.newObjectRequest("HEAD", key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	s.c.setSSECustomer(req.Header, "X-Amz-")
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return resp.Header, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil
+	}
+	return nil, s.statusError(resp)
+}
+
+// statusError returns the error for resp, the unexpected response to a GET
+// or HEAD request for an object.
+func (s s3Store) statusError(resp *http.Response) error {
+	e := newStatusError(resp)
+	if s.c.sseCustomerKeyMissing(resp, e) {
+		return ErrSSECustomerKey
+	}
+	return e
+}
+
+func (s s3Store) Put(ctx context.Context, key string, body io.Reader, size int64, h http.Header) error {
+	if s.c.multipart(size) {
+		return s.putMultipart(ctx, key, body, h)
+	}
+	if h.Get("Content-Md5") == "" && objectLockedHeader(h) && size >= 0 {
+		// S3 requires the digest of locked objects, which for an object
+		// not uploaded in parts can only be computed in advance.
+		b, err := ioutil.ReadAll(io.LimitReader(body, size))
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum(b)
+		h = cloneHeader(h)
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		body = bytes.NewReader(b)
+	}
+	req, err := s.c.newObjectRequest("PUT", key, "", body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	s.c.setSSECustomer(req.Header, "X-Amz-")
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s s3Store) Delete(ctx context.Context, key string) error {
+	req, err := s.c.newObjectRequest("DELETE", key, "", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		resp.Body.Close()
+		return nil
+	}
+	// S3 reports deleting a missing object as success, but some compatible
+	// services respond 404 Not Found.
+	if err := newStatusError(resp); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []ObjectInfo
+}
+
+func (s s3Store) List(ctx context.Context, prefix string, fn func([]ObjectInfo) error) error {
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := s.c.newBucketRequest("GET", q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.c.do(ctx, req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return newStatusError(resp)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(result.Contents) > 0 {
+			if err := fn(result.Contents); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type deleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []deleteObject `xml:"Object"`
+}
+
+type deleteObject struct {
+	Key string
+}
+
+type deleteResult struct {
+	Errors []ObjectError `xml:"Error"`
+}
+
+// DeleteObjects implements BatchDeleter, using as few S3 DeleteObjects
+// requests as possible, made concurrently within the Cache's MaxConcurrency.
+func (s s3Store) DeleteObjects(ctx context.Context, keys []string) error {
+	var (
+		mu       sync.Mutex
+		errs     BatchError
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteObjects {
+			n = maxDeleteObjects
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		ctx, release, err := s.c.acquire(ctx)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			batchErrs, err := s.deleteBatch(ctx, batch)
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, batchErrs...)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// deleteBatch deletes up to maxDeleteObjects objects in a single S3
+// DeleteObjects request, returning ObjectErrors for the objects that could
+// not be deleted.
+func (s s3Store) deleteBatch(ctx context.Context, keys []string) ([]error, error) {
+	batch := deleteRequest{Quiet: true, Objects: make([]deleteObject, len(keys))}
+	for i, key := range keys {
+		batch.Objects[i].Key = key
+	}
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.c.newBucketRequest("POST", "delete", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := s.c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	var result deleteResult
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(result.Errors))
+	for i := range result.Errors {
+		errs[i] = &result.Errors[i]
+	}
+	return errs, nil
+}
+
+// do signs req with the cache's credentials, using AWS Signature Version 4
+// unless SignatureV2 is set, and sends it on behalf of ctx, calling
+// PreSignHook before signing req and RequestHook after.
+// If the cache is anonymous, req is sent unsigned, and requests other than
+// GET and HEAD are not sent.
+func (c *Cache) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c.Anonymous && req.Method != "GET" && req.Method != "HEAD" {
+		return nil, ErrAnonymousWrite
+	}
+	keys, err := c.keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if c.PreSignHook != nil {
+		if err := c.PreSignHook(req); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case c.Anonymous:
+	case c.SignatureV2:
+		c.service().Sign(req, *keys)
+	default:
+		signV4(req, *keys, c.region(), time.Now())
+	}
+	if c.RequestHook != nil {
+		if err := c.RequestHook(req); err != nil {
+			return nil, err
+		}
+	}
+	c.countRequest(req)
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = countingBody{resp.Body, &c.stats.bytesIn}
+	return resp, nil
+}
+
+// newObjectRequest returns a request with the given method for the object
+// with the given key in the bucket, with the given raw query.
+func (c *Cache) newObjectRequest(method, objectKey, rawQuery string, body io.Reader) (*http.Request, error) {
+	u, err := c.objectURL(objectKey, rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequest(method, u.String(), body)
+}
+
+// newBucketRequest returns a request with the given method for the bucket
+// itself, with the given raw query.
+func (c *Cache) newBucketRequest(method, rawQuery string, body io.Reader) (*http.Request, error) {
+	return c.newObjectRequest(method, "", rawQuery, body)
+}
+
+// objectURL returns the URL of the object with the given key in the bucket,
+// with the given raw query. The key is joined to the path of BucketURL with
+// a single slash, and rawQuery to any query of BucketURL. If objectKey is
+// empty, it returns the URL of the bucket itself.
+func (c *Cache) objectURL(objectKey, rawQuery string) (*url.URL, error) {
+	if err := validateBucketURL(c.BucketURL); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(c.BucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if c.Accelerate {
+		if err := c.accelerateURL(u); err != nil {
+			return nil, err
+		}
+	}
+	if c.DualStack {
+		host := dualStackHost(u.Hostname(), c.region())
+		if port := u.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		u.Host = host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + objectKey
+	u.RawPath = ""
+	u.Fragment = ""
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = rawQuery
+	case rawQuery != "":
+		u.RawQuery += "&" + rawQuery
+	}
+	return u, nil
+}
+
+// dualStackHost returns the dual-stack (IPv4 and IPv6) form of the Amazon
+// S3 endpoint host in the given region, e.g.
+// "b.s3.dualstack.us-west-2.amazonaws.com" for "b.s3-us-west-2.amazonaws.com".
+// Hosts that are not Amazon S3 endpoints, or are already dual-stack, are
+// returned unchanged.
+func dualStackHost(host, region string) string {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".amazonaws.com") {
+		return host
+	}
+	labels := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		if label != "s3" && !strings.HasPrefix(label, "s3-") {
+			continue
+		}
+		if i+1 < len(labels) && labels[i+1] == "dualstack" {
+			return host
+		}
+		endpoint := "s3.dualstack." + region
+		switch label {
+		case "s3-accelerate":
+			endpoint = "s3-accelerate.dualstack"
+		case accessPointLabel:
+			endpoint = accessPointLabel + ".dualstack." + region
+		}
+		return strings.Join(append(labels[:i:i], endpoint), ".") + ".amazonaws.com"
+	}
+	return host
+}
+
+// client returns the HTTP client used for requests to S3.
+func (c *Cache) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	if c.Config.Client != nil {
+		return c.Config.Client
+	}
+	return http.DefaultClient
+}
+
+// service returns the S3 service used to sign requests. If PathStyle is
+// set, BucketURL's host is treated as the service domain, so that the signer
+// takes the bucket name from the request path rather than from the host.
+func (c *Cache) service() *s3.Service {
+	if !c.PathStyle {
+		return c.Config.Service
+	}
+	u, err := url.Parse(c.BucketURL)
+	if err != nil || u.Host == "" {
+		return c.Config.Service
+	}
+	var service s3.Service
+	if c.Config.Service != nil {
+		service = *c.Config.Service
+	}
+	service.Domain = strings.ToLower(u.Hostname())
+	return &service
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
+
+// A StatusError is returned when S3 responds with an unexpected HTTP
+// status. Stores other than the default may also return StatusErrors to
+// indicate the equivalent S3 failure.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unwanted http status %d: %q", e.StatusCode, e.Body)
+}
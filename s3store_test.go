@@ -0,0 +1,385 @@
+package s3cache_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sqs/s3"
+	"github.com/sqs/s3/s3util"
+	"sourcegraph.com/sourcegraph/s3cache"
+)
+
+// fakeS3 is a minimal S3 endpoint serving a single bucket, which supports
+// the object requests that a Cache without a Store makes for single
+// entries.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject // by request path
+}
+
+type fakeObject struct {
+	body   []byte
+	header http.Header
+}
+
+// newFakeS3 starts a fakeS3 and returns a Cache for its bucket.
+func newFakeS3(t *testing.T) (*fakeS3, *s3cache.Cache) {
+	f := &fakeS3{objects: make(map[string]fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c := &s3cache.Cache{
+		Config: s3util.Config{
+			Keys:    &s3.Keys{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"},
+			Service: s3.DefaultService,
+		},
+		BucketURL: srv.URL + "/bucket",
+	}
+	return f, c
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, exists := f.objects[r.URL.Path]
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		h := make(http.Header)
+		for k, vs := range r.Header {
+			if k == "Content-Type" || k == "Content-Encoding" || k == "X-Amz-Storage-Class" || k == "X-Amz-Tagging" || strings.HasPrefix(k, "X-Amz-Meta-") {
+				h[k] = vs
+			}
+		}
+		f.objects[r.URL.Path] = fakeObject{body, h}
+	case "GET", "HEAD":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if class := o.header.Get("X-Amz-Storage-Class"); r.Method == "GET" && (class == "GLACIER" || class == "DEEP_ARCHIVE") {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>")
+			return
+		}
+		for k, vs := range o.header {
+			w.Header()[k] = vs
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.body)))
+		if r.Method == "GET" {
+			w.Write(o.body)
+		}
+	case "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// put stores an object directly in the bucket, as an older version of the
+// package might have written it.
+func (f *fakeS3) put(path string, body []byte, h http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[path] = fakeObject{body, h}
+}
+
+// header returns the metadata stored with the object at path, or nil if
+// there is none.
+func (f *fakeS3) header(path string) http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[path]
+	if !ok {
+		return nil
+	}
+	return o.header
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	resp := []byte(strings.Repeat("cached response ", 100))
+	for _, c := range []struct {
+		name string
+		set  func(*s3cache.Cache)
+	}{
+		{"plain", func(*s3cache.Cache) {}},
+		{"Compress", func(c *s3cache.Cache) { c.Compress = true }},
+		{"Gzip", func(c *s3cache.Cache) { c.Gzip = true }},
+		{"Dedup", func(c *s3cache.Cache) { c.Dedup = true; c.Compress = true }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, cache := newFakeS3(t)
+			c.set(cache)
+			if err := cache.SetWithError("k", resp); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := cache.GetWithError("k")
+			if err != nil || !ok || !bytes.Equal(got, resp) {
+				t.Fatalf("got %q, %v, %v; want the entry", got, ok, err)
+			}
+			if err := cache.DeleteWithError("k"); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok, err := cache.GetWithError("k"); got != nil || ok || err != nil {
+				t.Fatalf("after Delete, got %q, %v, %v; want a miss", got, ok, err)
+			}
+		})
+	}
+}
+
+// TestCompressionMigration checks that entries written with different
+// codecs and settings in the same bucket remain readable as the settings
+// change.
+func TestCompressionMigration(t *testing.T) {
+	f, c := newFakeS3(t)
+	entries := map[string][]byte{
+		"compressed":   []byte(strings.Repeat("a", 1000)),
+		"plain":        []byte(strings.Repeat("b", 1000)),
+		"legacy-gzip":  []byte(strings.Repeat("c", 1000)),
+		"legacy-plain": []byte(strings.Repeat("d", 1000)),
+		"body":         []byte("HTTP/1.1 200 OK\r\nX-A: b\r\n\r\n" + strings.Repeat("e", 1000)),
+	}
+	c.Compress = true
+	if err := c.SetWithError("compressed", entries["compressed"]); err != nil {
+		t.Fatal(err)
+	}
+	c.Compress = false
+	if err := c.SetWithError("plain", entries["plain"]); err != nil {
+		t.Fatal(err)
+	}
+	c.CompressBody = true
+	if err := c.SetWithError("body", entries["body"]); err != nil {
+		t.Fatal(err)
+	}
+	c.CompressBody = false
+	// Entries written before codecs were recorded.
+	f.put("/bucket/"+c.ObjectKey("legacy-gzip"), gzipped(t, entries["legacy-gzip"]), http.Header{"Content-Encoding": {"gzip"}})
+	f.put("/bucket/"+c.ObjectKey("legacy-plain"), entries["legacy-plain"], http.Header{})
+
+	for _, compress := range []bool{false, true} {
+		c.Compress = compress
+		for key, want := range entries {
+			got, ok, err := c.GetWithError(key)
+			if err != nil || !ok || !bytes.Equal(got, want) {
+				t.Errorf("Compress=%v: %s: got %q, %v, %v; want the entry", compress, key, got, ok, err)
+			}
+		}
+	}
+
+	f.put("/bucket/"+c.ObjectKey("zstd"), []byte("x"), http.Header{"X-Amz-Meta-Compression": {"zstd"}})
+	if _, _, err := c.GetWithError("zstd"); err == nil {
+		t.Error("got no error for an entry with an unknown codec")
+	}
+}
+
+// TestStorageClass checks that Set sends the storage class and tags, that
+// entries in Intelligent-Tiering are read as usual, and that archived
+// entries are misses.
+func TestStorageClass(t *testing.T) {
+	f, c := newFakeS3(t)
+	c.StorageClass = s3cache.StorageClassIntelligentTiering
+	c.Tags = map[string]string{"tier": "archive", "team": "a&b"}
+	if err := c.SetWithError("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	h := f.header("/bucket/" + c.ObjectKey("k"))
+	if got := h.Get("X-Amz-Storage-Class"); got != "INTELLIGENT_TIERING" {
+		t.Errorf("stored with storage class %q, want INTELLIGENT_TIERING", got)
+	}
+	if tags, err := url.ParseQuery(h.Get("X-Amz-Tagging")); err != nil || tags.Get("tier") != "archive" || tags.Get("team") != "a&b" {
+		t.Errorf("stored with tags %q, %v", h.Get("X-Amz-Tagging"), err)
+	}
+	if resp, ok, err := c.GetWithError("k"); err != nil || !ok || string(resp) != "v" {
+		t.Errorf("got %q, %v, %v; want the entry", resp, ok, err)
+	}
+
+	f.put("/bucket/"+c.ObjectKey("archived"), []byte("v"), http.Header{"X-Amz-Storage-Class": {"DEEP_ARCHIVE"}})
+	if resp, ok, err := c.GetWithError("archived"); err != nil || ok {
+		t.Errorf("for an archived entry, got %q, %v, %v; want a miss", resp, ok, err)
+	}
+}
+
+// TestS3StoreGetReaderTimeout checks that the read timeout of GetReader
+// lasts while the entry is streamed.
+func TestS3StoreGetReaderTimeout(t *testing.T) {
+	_, c := newFakeS3(t)
+	c.Timeout = time.Minute
+	resp := bytes.Repeat([]byte("x"), 1<<20)
+	if err := c.SetWithError("k", resp); err != nil {
+		t.Fatal(err)
+	}
+	r, ok, err := c.GetReader("k")
+	if err != nil || !ok {
+		t.Fatalf("GetReader = %v, %v; want the entry", ok, err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, resp) {
+		t.Fatalf("read %d bytes, %v; want the entry", len(got), err)
+	}
+}
+
+// TestObjectURL checks the URLs to which requests for an entry are sent,
+// through the presigned URL of the entry "k".
+func TestObjectURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		cache      func() (*s3cache.Cache, error)
+		want       string // without the signature parameters
+		wantRegion string
+		wantErr    bool
+	}{
+		{name: "path style", want: "https://s3.us-west-2.amazonaws.com/bucket/k", wantRegion: "us-west-2",
+			cache: bucket("https://s3.us-west-2.amazonaws.com/bucket")},
+		{name: "trailing slash", want: "https://s3.us-west-2.amazonaws.com/bucket/k", wantRegion: "us-west-2",
+			cache: bucket("https://s3.us-west-2.amazonaws.com/bucket/")},
+		{name: "virtual-hosted style", want: "https://bucket.s3.eu-west-1.amazonaws.com/k", wantRegion: "eu-west-1",
+			cache: bucket("https://bucket.s3.eu-west-1.amazonaws.com")},
+		{name: "path prefix", want: "https://s3.amazonaws.com/bucket/a/b/k", wantRegion: "us-east-1",
+			cache: bucket("https://s3.amazonaws.com/bucket/a/b/")},
+		{name: "port", want: "http://localhost:9000/bucket/k",
+			cache: bucket("http://localhost:9000/bucket")},
+		{name: "query", want: "http://localhost:9000/bucket/k?versioning=1",
+			cache: bucket("http://localhost:9000/bucket?versioning=1")},
+		{name: "escaped key", want: "http://localhost:9000/bucket/a%20b%3Fc",
+			cache: func() (*s3cache.Cache, error) {
+				c, err := bucket("http://localhost:9000/bucket")()
+				c.KeyFunc = func(string) string { return "a b?c" }
+				return c, err
+			}},
+		{name: "accelerate, path style", want: "https://bucket.s3-accelerate.amazonaws.com/k", wantRegion: "us-west-2",
+			cache: func() (*s3cache.Cache, error) {
+				c, err := bucket("https://s3.us-west-2.amazonaws.com/bucket")()
+				c.Accelerate = true
+				return c, err
+			}},
+		{name: "accelerate, virtual-hosted style", want: "https://bucket.s3-accelerate.amazonaws.com/p/k", wantRegion: "us-west-2",
+			cache: func() (*s3cache.Cache, error) {
+				c, err := bucket("https://bucket.s3.us-west-2.amazonaws.com/p")()
+				c.Accelerate = true
+				return c, err
+			}},
+		{name: "accelerate, bucket with periods", wantErr: true,
+			cache: func() (*s3cache.Cache, error) {
+				c, err := bucket("https://s3.us-west-2.amazonaws.com/my.bucket")()
+				c.Accelerate = true
+				return c, err
+			}},
+		{name: "dualstack", want: "https://s3.dualstack.us-west-2.amazonaws.com/bucket/k", wantRegion: "us-west-2",
+			cache: func() (*s3cache.Cache, error) {
+				c, err := bucket("https://s3.us-west-2.amazonaws.com/bucket")()
+				c.DualStack = true
+				return c, err
+			}},
+		{name: "access point", want: "https://ap-123456789012.s3-accesspoint.us-west-2.amazonaws.com/k", wantRegion: "us-west-2",
+			cache: accessPoint("arn:aws:s3:us-west-2:123456789012:accesspoint/ap")},
+		{name: "access point, dualstack", want: "https://ap-123456789012.s3-accesspoint.dualstack.us-west-2.amazonaws.com/k", wantRegion: "us-west-2",
+			cache: func() (*s3cache.Cache, error) {
+				c, err := accessPoint("arn:aws:s3:us-west-2:123456789012:accesspoint:ap")()
+				if err == nil {
+					c.DualStack = true
+				}
+				return c, err
+			}},
+		{name: "access point, accelerate", wantErr: true,
+			cache: func() (*s3cache.Cache, error) {
+				c, err := accessPoint("arn:aws:s3:us-west-2:123456789012:accesspoint/ap")()
+				if err == nil {
+					c.Accelerate = true
+				}
+				return c, err
+			}},
+		{name: "malformed access point ARN", wantErr: true,
+			cache: accessPoint("arn:aws:s3:us-west-2:1234:accesspoint/ap")},
+		{name: "no scheme", wantErr: true, cache: bucket("s3.amazonaws.com/bucket")},
+		{name: "no bucket", wantErr: true, cache: bucket("https://s3.amazonaws.com/")},
+		{name: "malformed", wantErr: true, cache: bucket("http://[::1/bucket")},
+	}
+	for _, test := range tests {
+		c, err := test.cache()
+		var presigned string
+		if err == nil {
+			presigned, err = c.PresignedURL("k", time.Minute)
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", test.name, presigned)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		u, err := url.Parse(presigned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		credential := q.Get("X-Amz-Credential")
+		for k := range q {
+			if strings.HasPrefix(k, "X-Amz-") {
+				q.Del(k)
+			}
+		}
+		u.RawQuery = q.Encode()
+		if got := u.String(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+		if test.wantRegion != "" && !strings.Contains(credential, "/"+test.wantRegion+"/") {
+			t.Errorf("%s: signed with credential %s, want region %s", test.name, credential, test.wantRegion)
+		}
+	}
+}
+
+// bucket returns a function returning a Cache for the bucket with the given
+// URL.
+func bucket(bucketURL string) func() (*s3cache.Cache, error) {
+	return func() (*s3cache.Cache, error) {
+		return &s3cache.Cache{
+			Config:    s3util.Config{Keys: &s3.Keys{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}},
+			BucketURL: bucketURL,
+			KeyFunc:   func(key string) string { return key },
+		}, nil
+	}
+}
+
+// accessPoint returns a function returning a Cache for the access point
+// with the given ARN.
+func accessPoint(arn string) func() (*s3cache.Cache, error) {
+	return func() (*s3cache.Cache, error) {
+		c, err := s3cache.NewForAccessPoint(arn)
+		if err != nil {
+			return nil, err
+		}
+		c.Config.Keys = &s3.Keys{AccessKey: "AKIDEXAMPLE", SecretKey: "secret"}
+		c.KeyFunc = func(key string) string { return key }
+		return c, nil
+	}
+}
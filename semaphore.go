@@ -0,0 +1,48 @@
+package s3cache
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultMaxConcurrency = 32
+
+// semaphore bounds the number of S3 requests that a Cache's batch
+// operations have in flight at once.
+type semaphore struct {
+	mu    sync.Mutex
+	slots chan struct{}
+}
+
+// heldSlot is the context key whose value is the Cache in whose semaphore a
+// request made with the context already holds a slot.
+type heldSlot struct{}
+
+// acquire waits for a slot in c's semaphore, which bounds the requests made
+// by batch operations to MaxConcurrency, or until ctx is done. It returns a
+// context for the requests made with the slot, and a function that releases
+// the slot. Operations made with a context that already holds a slot share
+// it, so that nested operations such as the parts of a multipart upload
+// made by WarmFromDir cannot deadlock.
+func (c *Cache) acquire(ctx context.Context) (context.Context, func(), error) {
+	if ctx.Value(heldSlot{}) == c {
+		return ctx, func() {}, nil
+	}
+	s := &c.sem
+	s.mu.Lock()
+	if s.slots == nil {
+		n := c.MaxConcurrency
+		if n <= 0 {
+			n = defaultMaxConcurrency
+		}
+		s.slots = make(chan struct{}, n)
+	}
+	slots := s.slots
+	s.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return context.WithValue(ctx, heldSlot{}, c), func() { <-slots }, nil
+	case <-ctx.Done():
+		return ctx, nil, ctx.Err()
+	}
+}
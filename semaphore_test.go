@@ -0,0 +1,84 @@
+package s3cache_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// countingStore is a Store that records the largest number of its calls
+// that were ever in flight at once.
+type countingStore struct {
+	*memstore.Store
+
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (s *countingStore) enter() func() {
+	s.mu.Lock()
+	s.inflight++
+	if s.inflight > s.max {
+		s.max = s.inflight
+	}
+	s.mu.Unlock()
+	// Hold the call long enough for the others to pile up.
+	time.Sleep(time.Millisecond)
+	return func() {
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+	}
+}
+
+func (s *countingStore) Get(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, error) {
+	defer s.enter()()
+	return s.Store.Get(ctx, key, h)
+}
+
+func (s *countingStore) Delete(ctx context.Context, key string) error {
+	defer s.enter()()
+	return s.Store.Delete(ctx, key)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const n = 4
+	st := &countingStore{Store: memstore.New()}
+	c := &s3cache.Cache{Store: st, MaxConcurrency: n}
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := "k" + strconv.Itoa(i)
+		keys = append(keys, key)
+		c.Set(key, []byte(key))
+	}
+
+	hits, err := c.GetMulti(keys)
+	if err != nil || len(hits) != len(keys) {
+		t.Fatalf("GetMulti returned %d entries, %v; want %d", len(hits), err, len(keys))
+	}
+	if st.max > n {
+		t.Errorf("GetMulti made %d concurrent Store calls, want at most %d", st.max, n)
+	}
+	if st.max < 2 {
+		t.Errorf("GetMulti made its Store calls one at a time")
+	}
+
+	st.max = 0
+	if err := c.DeleteMulti(keys); err != nil {
+		t.Fatal(err)
+	}
+	if st.max > n {
+		t.Errorf("DeleteMulti made %d concurrent Store calls, want at most %d", st.max, n)
+	}
+	if st.Len() != 0 {
+		t.Errorf("%d objects remain after DeleteMulti", st.Len())
+	}
+}
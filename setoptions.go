@@ -0,0 +1,42 @@
+package s3cache
+
+import "net/http"
+
+// SetOptions holds options for storing a single cache entry with
+// SetWithOptions. Fields that are unset leave the Cache's defaults in
+// effect.
+type SetOptions struct {
+	// StorageClass overrides the Cache's StorageClass.
+	StorageClass string
+
+	// ContentType overrides the Content-Type with which the entry would
+	// otherwise be stored, including that of a serialized HTTP response.
+	ContentType string
+
+	// ACL overrides the Cache's ACL.
+	ACL string
+
+	// Metadata holds user-defined metadata stored with the entry in
+	// addition to the Cache's Metadata, whose values it overrides.
+	Metadata map[string]string
+}
+
+// apply sets the options, if any, in h, the header with which an entry is
+// uploaded.
+func (o *SetOptions) apply(h http.Header) {
+	if o == nil {
+		return
+	}
+	if o.StorageClass != "" {
+		h.Set("X-Amz-Storage-Class", o.StorageClass)
+	}
+	if o.ContentType != "" {
+		h.Set("Content-Type", o.ContentType)
+	}
+	if o.ACL != "" {
+		h.Set("X-Amz-Acl", o.ACL)
+	}
+	for name, value := range o.Metadata {
+		h.Set("X-Amz-Meta-"+name, value)
+	}
+}
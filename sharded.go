@@ -0,0 +1,88 @@
+package s3cache
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// shardReplicas is the number of points on the hash ring for each shard of
+// a ShardedCache. More points spread keys more evenly across shards.
+const shardReplicas = 128
+
+// A ShardedCache spreads cache entries across several Caches, such as Caches
+// for buckets in different regions, by consistent hashing of their keys.
+// Each key is always stored in the same shard, and adding or removing a
+// shard only moves the keys of about 1/n of the entries, for n shards.
+//
+// Shards are identified by their BucketURL and Prefix, not by their order,
+// so each shard must have a distinct BucketURL or Prefix.
+//
+// A ShardedCache is safe for concurrent use by multiple goroutines.
+type ShardedCache struct {
+	shards []*Cache
+	ring   []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// NewSharded returns a ShardedCache that spreads cache entries across the
+// given shards.
+func NewSharded(shards ...*Cache) *ShardedCache {
+	s := &ShardedCache{shards: shards, ring: make([]ringPoint, 0, len(shards)*shardReplicas)}
+	for i, c := range shards {
+		name := c.BucketURL + "|" + c.Prefix
+		for j := 0; j < shardReplicas; j++ {
+			s.ring = append(s.ring, ringPoint{hash: hashString(name + "#" + strconv.Itoa(j)), shard: i})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return s
+}
+
+// Shard returns the Cache in which the cache entry for key is stored, or
+// nil if s has no shards.
+func (s *ShardedCache) Shard(key string) *Cache {
+	if len(s.ring) == 0 {
+		return nil
+	}
+	h := hashString(key)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.shards[s.ring[i].shard]
+}
+
+func (s *ShardedCache) Get(key string) (resp []byte, ok bool) {
+	c := s.Shard(key)
+	if c == nil {
+		return nil, false
+	}
+	return c.Get(key)
+}
+
+func (s *ShardedCache) Set(key string, resp []byte) {
+	if c := s.Shard(key); c != nil {
+		c.Set(key, resp)
+	}
+}
+
+func (s *ShardedCache) Delete(key string) {
+	if c := s.Shard(key); c != nil {
+		c.Delete(key)
+	}
+}
+
+// hashString returns the position of s on the hash ring. It uses MD5,
+// rather than a faster hash such as FNV, because similar strings, such as
+// the names of a shard's points or sequential cache keys, must be spread
+// across the whole ring.
+func hashString(s string) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
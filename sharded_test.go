@@ -0,0 +1,92 @@
+package s3cache_test
+
+import (
+	"strconv"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+func shards(n int) []*s3cache.Cache {
+	var cs []*s3cache.Cache
+	for i := 0; i < n; i++ {
+		cs = append(cs, &s3cache.Cache{Store: memstore.New(), Prefix: "shard" + strconv.Itoa(i)})
+	}
+	return cs
+}
+
+func TestShardedCache(t *testing.T) {
+	cs := shards(3)
+	s := s3cache.NewSharded(cs...)
+	for i := 0; i < 100; i++ {
+		key := "k" + strconv.Itoa(i)
+		s.Set(key, []byte(key))
+		if resp, ok := s.Shard(key).Get(key); !ok || string(resp) != key {
+			t.Fatalf("%s is not in its shard: got %q, %v", key, resp, ok)
+		}
+		if resp, ok := s.Get(key); !ok || string(resp) != key {
+			t.Fatalf("Get(%q) = %q, %v", key, resp, ok)
+		}
+	}
+	var total int
+	for i, c := range cs {
+		n := c.Store.(*memstore.Store).Len()
+		if n == 0 {
+			t.Errorf("shard %d holds no entries", i)
+		}
+		total += n
+	}
+	if total != 100 {
+		t.Errorf("shards hold %d entries, want 100", total)
+	}
+	s.Delete("k0")
+	if _, ok := s.Get("k0"); ok {
+		t.Error("Get after Delete returned a hit")
+	}
+	if c := s3cache.NewSharded().Shard("k"); c != nil {
+		t.Error("a ShardedCache without shards returned a shard")
+	}
+}
+
+// TestShardedCacheRemapping checks that adding or removing a shard only
+// moves the keys that must move, which are about 1/n of them.
+func TestShardedCacheRemapping(t *testing.T) {
+	const keys = 10000
+	cs := shards(5)
+	four := s3cache.NewSharded(cs[:4]...)
+	five := s3cache.NewSharded(cs...)
+	// Shards are identified by name, not by position.
+	without := s3cache.NewSharded(cs[0], cs[1], cs[3], cs[4])
+
+	var added, removed int
+	counts := make(map[*s3cache.Cache]int)
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		counts[five.Shard(key)]++
+		before := four.Shard(key)
+		if after := five.Shard(key); after != before {
+			added++
+			if after != cs[4] {
+				t.Fatalf("adding a shard moved %s to an existing shard", key)
+			}
+		}
+		if after := without.Shard(key); five.Shard(key) != after {
+			removed++
+			if five.Shard(key) != cs[2] {
+				t.Fatalf("removing a shard moved %s, which was not in it", key)
+			}
+		}
+	}
+	for i, c := range cs {
+		if frac := float64(counts[c]) / keys; frac < 0.1 || frac > 0.3 {
+			t.Errorf("shard %d holds %.0f%% of keys, want about 20%%", i, 100*frac)
+		}
+	}
+	// With 5 shards, about 1/5 of the keys should move.
+	for name, moved := range map[string]int{"adding": added, "removing": removed} {
+		if frac := float64(moved) / keys; frac < 0.1 || frac > 0.3 {
+			t.Errorf("%s a shard moved %.0f%% of keys, want about 20%%", name, 100*frac)
+		}
+	}
+}
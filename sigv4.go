@@ -0,0 +1,253 @@
+package s3cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sqs/s3"
+)
+
+// maxPresignExpiry is the longest validity S3 allows for a presigned URL.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// PresignedURL returns a URL, signed with AWS Signature Version 4, that
+// allows anyone holding it to GET the object of the cache entry for key
+// until expiry elapses. Note that the object is the stored entry, which is
+// gzipped, in whole or in part, if Gzip, Compress or CompressBody is set.
+// The expiry may be at most 7 days.
+func (c *Cache) PresignedURL(key string, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return "", errors.New("s3cache: presigned URL expiry must be positive and at most 7 days")
+	}
+	keys, err := c.keys(context.Background())
+	if err != nil {
+		return "", err
+	}
+	u, err := c.url(key)
+	if err != nil {
+		return "", err
+	}
+	return presignV4("GET", u, *keys, c.region(), expiry, c.now()), nil
+}
+
+// region returns the AWS region of the bucket: Region if it is set, or
+// else the region derived from the host of BucketURL if possible, and
+// otherwise the AWS_REGION environment variable, defaulting to us-east-1.
+func (c *Cache) region() string {
+	if c.Region != "" {
+		return c.Region
+	}
+	if u, err := url.Parse(c.BucketURL); err == nil {
+		if region := regionFromHost(u.Hostname()); region != "" {
+			return region
+		}
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// regionFromHost returns the AWS region named in an Amazon S3 endpoint host,
+// such as "s3.us-west-2.amazonaws.com", "s3-us-west-2.amazonaws.com" or
+// "mybucket.s3.us-west-2.amazonaws.com". It returns "us-east-1" for the
+// global endpoint, and "" if host is not an Amazon S3 endpoint.
+func regionFromHost(host string) string {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".amazonaws.com") {
+		return ""
+	}
+	labels := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		switch {
+		case label == "s3" && i == len(labels)-1:
+			return "us-east-1"
+		case label == "s3":
+			// Skip labels such as "dualstack" in
+			// "s3.dualstack.us-west-2.amazonaws.com".
+			return labels[len(labels)-1]
+		case label == accessPointLabel:
+			// Skip any "dualstack" label, as above.
+			return labels[len(labels)-1]
+		case label == "s3-accelerate":
+			// The accelerate endpoint does not name the bucket's region.
+			return ""
+		case label == "s3-external-1":
+			return "us-east-1"
+		case strings.HasPrefix(label, "s3-"):
+			return strings.TrimPrefix(label, "s3-")
+		}
+	}
+	return ""
+}
+
+// presignV4 returns u presigned for the given method with AWS Signature
+// Version 4, valid for expiry from now.
+func presignV4(method string, u *url.URL, keys s3.Keys, region string, expiry time.Duration, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", keys.AccessKey+"/"+scope)
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if keys.SecurityToken != "" {
+		q.Set("X-Amz-Security-Token", keys.SecurityToken)
+	}
+	query := canonicalQuery(q)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		uriEncode(u.Path, false),
+		query,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(
+		signingKey(keys.SecretKey, date, region),
+		stringToSign(now, scope, canonicalRequest),
+	))
+
+	presigned := *u
+	// Send the path exactly as it is signed, since String would leave some
+	// reserved characters, such as '+' and '=', unescaped.
+	presigned.RawPath = uriEncode(u.Path, false)
+	presigned.RawQuery = query + "&X-Amz-Signature=" + signature
+	return presigned.String()
+}
+
+// signV4 signs req with AWS Signature Version 4, in its Authorization
+// header, as of now. The payload is not signed unless req has an
+// X-Amz-Content-Sha256 header with its digest.
+func signV4(req *http.Request, keys s3.Keys, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if keys.SecurityToken != "" {
+		req.Header.Set("X-Amz-Security-Token", keys.SecurityToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		switch {
+		case strings.HasPrefix(k, "x-amz-"), k == "content-md5", k == "content-type", k == "range", k == "if-none-match":
+			values := make([]string, len(vs))
+			for i, v := range vs {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[k] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Send the path exactly as it is signed.
+	path := uriEncode(req.URL.Path, false)
+	if path == "" {
+		path = "/"
+	}
+	req.URL.RawPath = path
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(
+		signingKey(keys.SecretKey, date, region),
+		stringToSign(now, scope, canonicalRequest),
+	))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keys.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// stringToSign returns the Signature Version 4 string to sign for the given
+// canonical request.
+func stringToSign(now time.Time, scope, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	return "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+}
+
+// signingKey derives the Signature Version 4 signing key for S3 requests
+// made on the given date in the given region.
+func signingKey(secretKey, date, region string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secretKey), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns q encoded as a Signature Version 4 canonical query
+// string: sorted by key, with keys and values URI-encoded.
+func canonicalQuery(q url.Values) string {
+	var params []string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes every byte of s other than the unreserved
+// characters, as Signature Version 4 requires. Slashes are encoded only if
+// encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' && !encodeSlash {
+			b = append(b, ch)
+		} else {
+			b = append(b, '%', hexDigits[ch>>4], hexDigits[ch&15])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,202 @@
+package s3cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// transferWorkers is the number of cache entries that WarmFromDir and
+// ExportToDir transfer at once.
+const transferWorkers = 8
+
+// WarmFromDir stores the contents of each file in dir, recursively, as a
+// cache entry. Files are named by the object keys of their entries,
+// relative to Prefix and KeyVersion and without the ".gz" suffix added by
+// Gzip, as written by ExportToDir; if KeyFunc is the identity function,
+// these are the cache keys. Entries are stored according to the Cache's
+// settings, as by Set.
+//
+// If some of the files could not be stored, WarmFromDir stores the others
+// and returns a BatchError of ObjectErrors naming the files.
+func (c *Cache) WarmFromDir(dir string) error {
+	if err := c.permit("Set"); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	var (
+		mu   sync.Mutex
+		errs BatchError
+		wg   sync.WaitGroup
+	)
+	names := make(chan string)
+	for i := 0; i < transferWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if err := c.warm(ctx, dir, name); err != nil && !skipped(err) {
+					mu.Lock()
+					errs = append(errs, &ObjectError{Key: name, Message: err.Error()})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names <- filepath.ToSlash(name)
+		return nil
+	})
+	close(names)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// warm stores the file with the given name in dir as a cache entry.
+func (c *Cache) warm(ctx context.Context, dir, name string) error {
+	ctx, release, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	objectKey := c.keyPrefix() + name
+	if c.Gzip {
+		objectKey += ".gz"
+	}
+	resp, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	if c.tooLarge(int64(len(resp))) {
+		err = ErrTooLarge
+	} else {
+		err = c.retry(ctx, "Set", objectKey, func() error {
+			_, err := c.put(ctx, "", objectKey, resp, nil)
+			return err
+		})
+	}
+	if err == nil {
+		c.forgetMiss(objectKey)
+	}
+	c.reportSet(objectKey, err)
+	return err
+}
+
+// ExportToDir writes each cache entry to a file in dir, named by its
+// object key relative to Prefix and KeyVersion, creating subdirectories as
+// needed. Entries are written as Get returns them, decompressed, whether or
+// not they are deduplicated. The files can be loaded into a cache with the
+// same Prefix and KeyFunc with WarmFromDir. Expired and negative cache
+// entries are not exported.
+//
+// If some of the entries could not be exported, ExportToDir exports the
+// others and returns a BatchError of ObjectErrors naming their objects.
+func (c *Cache) ExportToDir(dir string) error {
+	if err := c.permit("Get"); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	var (
+		mu   sync.Mutex
+		errs BatchError
+		wg   sync.WaitGroup
+	)
+	keys := make(chan string)
+	for i := 0; i < transferWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objectKey := range keys {
+				if err := c.export(ctx, dir, objectKey); err != nil {
+					c.onError("Get", objectKey, err)
+					mu.Lock()
+					errs = append(errs, &ObjectError{Key: objectKey, Message: err.Error()})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	err := c.store().List(ctx, c.keyPrefix(), func(objects []ObjectInfo) error {
+		for _, o := range objects {
+			if !strings.HasSuffix(o.Key, "/") && c.isEntryKey(o.Key) {
+				keys <- o.Key
+			}
+		}
+		return nil
+	})
+	close(keys)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// export writes the cache entry in the object with the given key to a file
+// in dir.
+func (c *Cache) export(ctx context.Context, dir, objectKey string) error {
+	name := strings.TrimPrefix(objectKey, c.keyPrefix())
+	if c.Gzip {
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("s3cache: cannot export object %q outside of %s", objectKey, dir)
+	}
+	ctx, release, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	var rdr io.ReadCloser
+	err = c.retry(ctx, "Get", objectKey, func() (err error) {
+		rdr, _, _, err = c.openObject(ctx, objectKey, objectKey, nil)
+		return err
+	})
+	if err == ErrNegativeCached || (err == nil && rdr == nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rdr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
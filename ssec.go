@@ -0,0 +1,38 @@
+package s3cache
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrSSECustomerKey is returned when S3 refuses to read a cache entry
+// because it is encrypted with a customer-provided key (SSE-C) and the Cache
+// has no SSECustomerKey.
+var ErrSSECustomerKey = errors.New("s3cache: cache entry is encrypted with a customer-provided key (SSE-C), but the Cache has no SSECustomerKey")
+
+// setSSECustomer sets the headers that tell S3 to encrypt or decrypt an
+// object with c.SSECustomerKey, if it is set. The prefix is "X-Amz-" for
+// the object of a request, and "X-Amz-Copy-Source-" for the source of a
+// copy.
+func (c *Cache) setSSECustomer(h http.Header, prefix string) {
+	if len(c.SSECustomerKey) == 0 {
+		return
+	}
+	sum := md5.Sum(c.SSECustomerKey)
+	h.Set(prefix+"Server-Side-Encryption-Customer-Algorithm", "AES256")
+	h.Set(prefix+"Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(c.SSECustomerKey))
+	h.Set(prefix+"Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// sseCustomerKeyMissing reports whether resp, the response to a GET or HEAD
+// request without SSE-C headers, indicates that the object is encrypted with
+// SSE-C. S3 responds to HEAD requests without a body.
+func (c *Cache) sseCustomerKeyMissing(resp *http.Response, e *StatusError) bool {
+	if len(c.SSECustomerKey) > 0 || resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	return resp.Request.Method == "HEAD" || strings.Contains(e.Body, "Server Side Encryption")
+}
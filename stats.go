@@ -0,0 +1,83 @@
+package s3cache
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// CacheStats is a cumulative count of the requests a Cache has sent to S3,
+// by class, and of the bytes it has transferred, which correspond to the
+// dimensions in which S3 prices requests and data transfer. It counts each
+// attempt of a retried request. Requests made through a Store other than
+// the default are not counted.
+type CacheStats struct {
+	GetRequests    int64 // GET requests for objects
+	HeadRequests   int64
+	PutRequests    int64 // PUT requests, including those for upload parts and copies
+	PostRequests   int64 // POST requests, such as for multipart uploads and batch deletes
+	DeleteRequests int64
+	ListRequests   int64 // GET requests that list the bucket
+
+	BytesIn  int64 // bytes of response bodies received from S3
+	BytesOut int64 // bytes of request bodies sent to S3
+}
+
+// costStats holds the atomic counters from which Stats takes a CacheStats.
+type costStats struct {
+	get, head, put, post, del, list atomic.Int64
+	bytesIn, bytesOut               atomic.Int64
+}
+
+// Stats returns the requests the Cache has sent to S3 and the bytes it has
+// transferred so far.
+func (c *Cache) Stats() CacheStats {
+	s := &c.stats
+	return CacheStats{
+		GetRequests:    s.get.Load(),
+		HeadRequests:   s.head.Load(),
+		PutRequests:    s.put.Load(),
+		PostRequests:   s.post.Load(),
+		DeleteRequests: s.del.Load(),
+		ListRequests:   s.list.Load(),
+		BytesIn:        s.bytesIn.Load(),
+		BytesOut:       s.bytesOut.Load(),
+	}
+}
+
+// countRequest counts req, which is about to be sent to S3.
+func (c *Cache) countRequest(req *http.Request) {
+	s := &c.stats
+	switch req.Method {
+	case "GET":
+		if req.URL.Query().Has("list-type") {
+			s.list.Add(1)
+		} else {
+			s.get.Add(1)
+		}
+	case "HEAD":
+		s.head.Add(1)
+	case "PUT":
+		s.put.Add(1)
+	case "POST":
+		s.post.Add(1)
+	case "DELETE":
+		s.del.Add(1)
+	}
+	if req.ContentLength > 0 {
+		s.bytesOut.Add(req.ContentLength)
+	}
+}
+
+// countingBody is a response body that counts the bytes read from it as
+// received from S3.
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,108 @@
+package s3cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// A Store is the object storage in which a Cache keeps its entries. By
+// default, a Cache stores objects in Amazon S3 (or an S3-compatible service)
+// as configured by its fields; setting the Cache's Store lets it use a
+// different S3 client, or an in-memory fake in tests.
+//
+// Object keys passed to a Store are relative to the bucket. Object metadata
+// (such as Content-Encoding and X-Amz-Meta-* headers) and request options
+// are passed as HTTP headers, in the form in which S3 accepts them.
+type Store interface {
+	// Get returns the body of the object with the given key and its
+	// metadata. The header h holds additional request options. If the
+	// object does not exist, Get returns a nil body and a nil error.
+	Get(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, error)
+
+	// Head returns the metadata of the object with the given key. If the
+	// object does not exist, Head returns a nil header and a nil error.
+	Head(ctx context.Context, key string) (http.Header, error)
+
+	// Put stores size bytes read from body as the object with the given key,
+	// with the metadata and options in h. If size is negative, the size of
+	// the object is not known in advance. If Put fails, the object must not
+	// be left partially written.
+	Put(ctx context.Context, key string, body io.Reader, size int64, h http.Header) error
+
+	// Delete deletes the object with the given key. Deleting an object that
+	// does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List lists the objects whose keys begin with prefix, calling fn with
+	// each page of results. If fn returns an error, listing stops and List
+	// returns the error.
+	List(ctx context.Context, prefix string, fn func([]ObjectInfo) error) error
+}
+
+// A BatchDeleter is a Store that can delete many objects at once. Batch
+// operations such as Clear and DeleteMulti use DeleteObjects if the Cache's
+// Store implements it, and delete objects one at a time otherwise.
+type BatchDeleter interface {
+	// DeleteObjects deletes the objects with the given keys. If some of the
+	// objects could not be deleted, it returns a BatchError of
+	// ObjectErrors describing them.
+	DeleteObjects(ctx context.Context, keys []string) error
+}
+
+// store returns the Store in which the Cache keeps its entries.
+func (c *Cache) store() Store {
+	if c.Store != nil {
+		return c.Store
+	}
+	return s3Store{c}
+}
+
+// deleteObjects deletes the objects with the given keys from the Cache's
+// Store, in batches if the Store supports it, and otherwise one at a time,
+// concurrently within the Cache's MaxConcurrency.
+func (c *Cache) deleteObjects(ctx context.Context, keys []string) error {
+	if bd, ok := c.store().(BatchDeleter); ok {
+		return bd.DeleteObjects(ctx, keys)
+	}
+	var (
+		mu       sync.Mutex
+		errs     BatchError
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for _, key := range keys {
+		ctx, release, err := c.acquire(ctx)
+		if err != nil {
+			firstErr = err
+			break
+		}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer release()
+			err := c.store().Delete(ctx, key)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				return
+			}
+			oe := &ObjectError{Key: key, Message: err.Error()}
+			var se *StatusError
+			if errors.As(err, &se) {
+				oe.Code = se.code()
+			}
+			mu.Lock()
+			errs = append(errs, oe)
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package s3cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A TieredCache is a cache that keeps recently used entries in an in-memory
+// LRU cache in front of a Cache stored in S3. Get serves entries from memory
+// when possible and otherwise falls through to S3, populating the in-memory
+// cache; Set and Delete write through to S3.
+//
+// A TieredCache is safe for concurrent use by multiple goroutines.
+type TieredCache struct {
+	// S3 is the underlying S3-backed cache.
+	S3 *Cache
+
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *tieredEntry, most recently used first
+	size    int64
+	fills   map[string]*tieredFill
+}
+
+// A tieredFill tracks the Gets of a key that are reading its entry from S3
+// to add it to the in-memory cache. If the key is written meanwhile, the
+// entry they read may be stale, so it is not added.
+type tieredFill struct {
+	n     int // Gets in flight
+	stale bool
+}
+
+type tieredEntry struct {
+	key  string
+	resp []byte
+}
+
+// NewTiered returns a TieredCache in front of c that holds at most
+// maxEntries entries totalling at most maxBytes bytes in memory. A limit of
+// zero means no limit.
+func NewTiered(c *Cache, maxEntries int, maxBytes int64) *TieredCache {
+	return &TieredCache{
+		S3:         c,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		fills:      make(map[string]*tieredFill),
+	}
+}
+
+func (t *TieredCache) Get(key string) (resp []byte, ok bool) {
+	t.mu.Lock()
+	if e, ok := t.entries[key]; ok {
+		t.lru.MoveToFront(e)
+		resp := e.Value.(*tieredEntry).resp
+		t.mu.Unlock()
+		return resp, true
+	}
+	f := t.fills[key]
+	if f == nil {
+		f = new(tieredFill)
+		t.fills[key] = f
+	}
+	f.n++
+	t.mu.Unlock()
+
+	resp, ok = t.S3.Get(key)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok && !f.stale {
+		t.add(key, resp)
+	}
+	if f.n--; f.n == 0 {
+		delete(t.fills, key)
+	}
+	return resp, ok
+}
+
+func (t *TieredCache) Set(key string, resp []byte) {
+	t.mu.Lock()
+	t.written(key)
+	t.add(key, resp)
+	t.mu.Unlock()
+	t.S3.Set(key, resp)
+}
+
+func (t *TieredCache) Delete(key string) {
+	t.mu.Lock()
+	t.written(key)
+	if e, ok := t.entries[key]; ok {
+		t.remove(e)
+	}
+	t.mu.Unlock()
+	t.S3.Delete(key)
+}
+
+// written records that key was written, so that Gets of it in flight do
+// not add the entries they read to the in-memory cache. The caller must
+// hold t.mu.
+func (t *TieredCache) written(key string) {
+	if f := t.fills[key]; f != nil {
+		f.stale = true
+	}
+}
+
+// add adds the entry to the in-memory cache, evicting the least recently
+// used entries as needed to stay within its limits. The caller must hold
+// t.mu.
+func (t *TieredCache) add(key string, resp []byte) {
+	if t.maxBytes > 0 && int64(len(resp)) > t.maxBytes {
+		if e, ok := t.entries[key]; ok {
+			t.remove(e)
+		}
+		return
+	}
+	if resp == nil {
+		resp = []byte{}
+	}
+	if e, ok := t.entries[key]; ok {
+		t.remove(e)
+	}
+	t.entries[key] = t.lru.PushFront(&tieredEntry{key: key, resp: resp})
+	t.size += int64(len(resp))
+	for (t.maxEntries > 0 && t.lru.Len() > t.maxEntries) || (t.maxBytes > 0 && t.size > t.maxBytes) {
+		t.remove(t.lru.Back())
+	}
+}
+
+// remove removes e from the in-memory cache. The caller must hold t.mu.
+func (t *TieredCache) remove(e *list.Element) {
+	entry := t.lru.Remove(e).(*tieredEntry)
+	delete(t.entries, entry.key)
+	t.size -= int64(len(entry.resp))
+}
@@ -0,0 +1,90 @@
+package s3cache_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// pausingStore is a Store whose Gets, once paused, wait after reading an
+// object until they are resumed.
+type pausingStore struct {
+	*memstore.Store
+	read   chan struct{} // receives after each paused Get reads
+	resume chan struct{}
+}
+
+func (s *pausingStore) Get(ctx context.Context, key string, h http.Header) (io.ReadCloser, http.Header, error) {
+	body, rh, err := s.Store.Get(ctx, key, h)
+	if s.read != nil {
+		s.read <- struct{}{}
+		<-s.resume
+	}
+	return body, rh, err
+}
+
+// TestTieredWriteDuringFill checks that a Get that reads an entry from S3
+// before a concurrent Set or Delete of its key does not fill the in-memory
+// cache with the stale entry.
+func TestTieredWriteDuringFill(t *testing.T) {
+	for _, write := range []string{"Set", "Delete"} {
+		st := &pausingStore{Store: memstore.New()}
+		tc := s3cache.NewTiered(&s3cache.Cache{Store: st}, 0, 0)
+		tc.S3.Set("k", []byte("old"))
+
+		st.read, st.resume = make(chan struct{}), make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tc.Get("k")
+		}()
+		<-st.read
+		st.read = nil
+		if write == "Set" {
+			tc.Set("k", []byte("new"))
+		} else {
+			tc.Delete("k")
+		}
+		close(st.resume)
+		<-done
+
+		resp, ok := tc.Get("k")
+		switch {
+		case write == "Set" && string(resp) != "new":
+			t.Errorf("after Set during a fill, Get = %q, %v; want %q", resp, ok, "new")
+		case write == "Delete" && ok:
+			t.Errorf("after Delete during a fill, Get = %q, %v; want a miss", resp, ok)
+		}
+	}
+}
+
+func TestTieredConcurrent(t *testing.T) {
+	tc := s3cache.NewTiered(&s3cache.Cache{Store: memstore.New()}, 10, 1<<10)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(j % 20)
+				switch (i + j) % 3 {
+				case 0:
+					tc.Set(key, []byte(key))
+				case 1:
+					if resp, ok := tc.Get(key); ok && string(resp) != key {
+						t.Errorf("Get(%q) = %q", key, resp)
+					}
+				case 2:
+					tc.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,70 @@
+package s3cache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// A Tracer traces the operations of a Cache, e.g. by creating OpenTelemetry
+// spans for them. Defining Tracer here, rather than depending on a tracing
+// library, keeps the package free of tracing dependencies; an adapter for
+// OpenTelemetry is a few lines of code.
+type Tracer interface {
+	// StartSpan is called when an operation ("Get", "Set" or "Delete") on
+	// the cache entry with the given object key begins. It returns the
+	// context in which the operation runs, which may carry the span, and a
+	// function that is called with the outcome of the operation when it
+	// ends.
+	StartSpan(ctx context.Context, op, objectKey string) (context.Context, func(SpanResult))
+}
+
+// SpanResult describes the outcome of a traced operation.
+type SpanResult struct {
+	// Bytes is the size of the cache entry read or written.
+	Bytes int
+
+	// StatusCode is the HTTP status of S3's response: 200 on success, 404
+	// on a cache miss, and the status of the StatusError for S3 errors. It
+	// is 0 if the operation failed without a response from S3.
+	StatusCode int
+
+	// Err is the error with which the operation failed, if any.
+	Err error
+}
+
+func noopEndSpan(SpanResult) {}
+
+// startSpan starts tracing an operation on the cache entry for key with the
+// Cache's Tracer, if any. The returned function also calls OnComplete.
+func (c *Cache) startSpan(ctx context.Context, op, key string) (context.Context, func(SpanResult)) {
+	endSpan := noopEndSpan
+	if c.Tracer != nil {
+		ctx, endSpan = c.Tracer.StartSpan(ctx, op, c.ObjectKey(key))
+	}
+	if c.OnComplete == nil {
+		return ctx, endSpan
+	}
+	start := time.Now()
+	return ctx, func(r SpanResult) {
+		c.OnComplete(op, r.Bytes, time.Since(start), r.Err)
+		endSpan(r)
+	}
+}
+
+// spanResult returns the SpanResult of an operation that transferred n
+// bytes. The operation found no cache entry if found is false.
+func spanResult(n int, found bool, err error) SpanResult {
+	r := SpanResult{Bytes: n, StatusCode: http.StatusOK, Err: err}
+	switch err := err.(type) {
+	case nil:
+		if !found {
+			r.StatusCode = http.StatusNotFound
+		}
+	case *StatusError:
+		r.StatusCode = err.StatusCode
+	default:
+		r.StatusCode = 0
+	}
+	return r
+}
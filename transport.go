@@ -0,0 +1,18 @@
+package s3cache
+
+import "github.com/gregjones/httpcache"
+
+var _ httpcache.Cache = (*Cache)(nil)
+
+// NewTransport returns an httpcache.Transport that caches HTTP responses in
+// a Cache for the S3 bucket at bucketURL, configured with opts as by
+// NewWithOptions. Its Client method returns an *http.Client that uses it.
+// Use NewWithOptions and httpcache.NewTransport directly for access to the
+// Cache itself.
+func NewTransport(bucketURL string, opts ...Option) (*httpcache.Transport, error) {
+	c, err := NewWithOptions(bucketURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return httpcache.NewTransport(c), nil
+}
@@ -0,0 +1,115 @@
+package s3cache
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Clock tells the current time. It allows time-dependent behavior, such as
+// TTL expiry, to be tested without waiting for real time to pass.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the current time according to the Cache's Clock.
+func (c *Cache) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+// cachedAtHeader is the header in which Set records when a cache entry was
+// written, so that its age can be determined on Get.
+const cachedAtHeader = "X-Amz-Meta-Cached-At"
+
+// expiresAtHeader is the header in which Set records when a cache entry
+// expires, if RespectCacheControl is set and the entry's response has a
+// max-age.
+const expiresAtHeader = "X-Amz-Meta-S3cache-Expires-At"
+
+// setFreshness records in the upload header h when the cache entry whose
+// response has the header rh expires according to its max-age, if
+// RespectCacheControl is set and it has one.
+func (c *Cache) setFreshness(h, rh http.Header) {
+	if !c.RespectCacheControl {
+		return
+	}
+	maxAge, ok := freshnessLifetime(rh)
+	if !ok {
+		return
+	}
+	expires := c.now().Add(maxAge).UTC()
+	h.Set(expiresAtHeader, expires.Format(time.RFC3339Nano))
+	h.Set("Expires", expires.Format(http.TimeFormat))
+}
+
+// maxAgeLimit is the largest max-age, in seconds, that freshnessLifetime
+// returns, so that the duration does not overflow.
+const maxAgeLimit = math.MaxInt64 / int64(time.Second)
+
+// freshnessLifetime returns the remaining freshness lifetime of a response
+// with the header h: the max-age of its Cache-Control header less its Age.
+// It reports false if there is no max-age directive.
+func freshnessLifetime(h http.Header) (time.Duration, bool) {
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if !strings.EqualFold(name, "max-age") {
+				continue
+			}
+			maxAge, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+			if maxAge -= age; maxAge < 0 {
+				maxAge = 0
+			} else if maxAge > maxAgeLimit {
+				maxAge = maxAgeLimit
+			}
+			return time.Duration(maxAge) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// expired reports whether the cache entry whose object has the response
+// header h has expired: if RespectCacheControl is set and Set recorded an
+// expiry for it, whether that has passed, and otherwise whether it is older
+// than the Cache's TTL. The age is determined from the entry's cached-at
+// metadata, or from its Last-Modified time if it was written without TTL
+// support.
+func (c *Cache) expired(h http.Header) bool {
+	if v := h.Get(expiresAtHeader); c.RespectCacheControl && v != "" {
+		if expires, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return !c.now().Before(expires)
+		}
+	}
+	if c.TTL <= 0 {
+		return false
+	}
+	cachedAt, err := time.Parse(time.RFC3339Nano, h.Get(cachedAtHeader))
+	if err != nil {
+		cachedAt, err = http.ParseTime(h.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+	}
+	return c.now().Sub(cachedAt) > c.TTL
+}
+
+// expire handles the expired cache entry for key, stored in the object with
+// the given key, deleting it if the Cache is configured to do so.
+func (c *Cache) expire(ctx context.Context, key, objectKey string) {
+	if !c.DeleteExpired || c.ReadOnly {
+		return
+	}
+	if err := c.store().Delete(ctx, objectKey); err != nil {
+		c.onError("Delete", key, err)
+	}
+}
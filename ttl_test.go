@@ -0,0 +1,63 @@
+package s3cache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/s3cache"
+	"sourcegraph.com/sourcegraph/s3cache/memstore"
+)
+
+// fakeClock is a Clock whose time only changes when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestTTLExpiry(t *testing.T) {
+	clock := newFakeClock()
+	st := memstore.New()
+	c := &s3cache.Cache{Store: st, TTL: time.Hour, Clock: clock}
+	c.Set("k", []byte("v"))
+
+	clock.Advance(59 * time.Minute)
+	if _, ok := c.Get("k"); !ok {
+		t.Fatal("entry expired before its TTL")
+	}
+	clock.Advance(2 * time.Minute)
+	if resp, ok := c.Get("k"); ok {
+		t.Fatalf("after its TTL, Get = %q, want a miss", resp)
+	}
+}
+
+func TestNegativeEntryExpiry(t *testing.T) {
+	clock := newFakeClock()
+	c := &s3cache.Cache{Store: memstore.New(), Clock: clock}
+	if err := c.SetMiss("k", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.GetWithError("k"); err == nil {
+		t.Fatal("got no ErrNegativeCached before the negative entry expired")
+	}
+	clock.Advance(time.Minute)
+	if _, ok, err := c.GetWithError("k"); ok || err != nil {
+		t.Errorf("after the negative entry expired, got %v, %v; want a miss", ok, err)
+	}
+}
@@ -0,0 +1,106 @@
+package s3cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrBucketNotFound is returned, wrapped, by Verify when the bucket
+	// does not exist.
+	ErrBucketNotFound = errors.New("s3cache: bucket does not exist")
+
+	// ErrWrongRegion is returned, wrapped, by Verify when the bucket is in
+	// a different AWS region than the one to which the Cache addresses and
+	// signs its requests.
+	ErrWrongRegion = errors.New("s3cache: bucket is in a different region")
+)
+
+// NewVerified is like NewValidated, but it also checks with Verify that the
+// bucket exists and is in the region that the Cache uses, so that a
+// misconfigured bucket is reported at startup.
+func NewVerified(bucketURL string) (*Cache, error) {
+	c, err := NewValidated(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verify(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Verify checks that the bucket exists and is in the region to which the
+// Cache signs its requests, with a HEAD request for the bucket, which
+// requires permission to list it. If the bucket is in another region, as
+// reported by S3, Verify returns an error wrapping ErrWrongRegion that
+// names the bucket's region and suggests a BucketURL for it. Verify does
+// nothing if the Cache has a Store.
+func (c *Cache) Verify() error {
+	return c.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, but it uses ctx for the request.
+func (c *Cache) VerifyContext(ctx context.Context) error {
+	if c.Store != nil {
+		return nil
+	}
+	ctx, cancel := c.withTimeout(ctx, "Get")
+	defer cancel()
+	req, err := c.newBucketRequest("HEAD", "", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	region := c.region()
+	if bucketRegion := resp.Header.Get("X-Amz-Bucket-Region"); bucketRegion != "" && bucketRegion != region {
+		resp.Body.Close()
+		return c.wrongRegion(region, bucketRegion)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, c.BucketURL)
+	case http.StatusMovedPermanently:
+		// S3 redirects requests sent to the wrong regional endpoint.
+		resp.Body.Close()
+		return fmt.Errorf("%w: S3 redirected the request for %s, signed for %s; set Region to the bucket's region", ErrWrongRegion, c.BucketURL, region)
+	}
+	return newStatusError(resp)
+}
+
+// wrongRegion returns the error reporting that the bucket is in
+// bucketRegion, not region.
+func (c *Cache) wrongRegion(region, bucketRegion string) error {
+	suggestion := fmt.Sprintf("set Region to %q", bucketRegion)
+	if bucket := c.bucketName(); bucket != "" && !c.Accelerate {
+		suggestion = fmt.Sprintf("use BucketURL %q and %s", bucketURLForRegion(bucket, bucketRegion), suggestion)
+	}
+	return fmt.Errorf("%w: %s is in %s, but requests are signed for %s; %s", ErrWrongRegion, c.BucketURL, bucketRegion, region, suggestion)
+}
+
+// bucketName returns the name of the bucket if BucketURL is an Amazon S3
+// URL, in path or virtual-hosted style, and "" otherwise.
+func (c *Cache) bucketName() string {
+	u, err := url.Parse(c.BucketURL)
+	if err != nil || !strings.HasSuffix(strings.ToLower(u.Hostname()), ".amazonaws.com") {
+		return ""
+	}
+	if _, ok := accessPointARN(u.Hostname()); ok {
+		return ""
+	}
+	if isPathStyleAmazonHost(u.Hostname()) {
+		return strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)[0]
+	}
+	return bucketFromHost(u.Hostname())
+}